@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ACL_DEFAULT_USER      string = "default"
+	ACL_LOG_GROUPING_TIME int64  = 60000 // ms，在这个时间内相同的拒绝记录合并为一条
+)
+
+// ACL 拒绝的原因
+const (
+	ACL_DENIED_CMD     string = "command"
+	ACL_DENIED_KEY     string = "key"
+	ACL_DENIED_CHANNEL string = "channel"
+	ACL_DENIED_AUTH    string = "auth"
+)
+
+var (
+	ErrAclSyntax          = errors.New("Syntax error")
+	ErrAclUnknownCommand  = errors.New("Unknown command or category name in ACL")
+	ErrAclBadHash         = errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+	ErrAclNoSuchPass      = errors.New("The password you are trying to remove from the user does not exist")
+	ErrAclPatternAfterAll = errors.New("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+)
+
+type aclUser struct {
+	name         string
+	enabled      bool
+	nopass       bool
+	passwords    map[string]struct{} // sha256后的密码
+	allowed      map[string]bool     // 允许执行的命令，key为命令的全名，例如 slowlog|get
+	cmdRules     []string            // 命令相关的规则，用于ACL LIST展示
+	allKeys      bool
+	keyPatterns  []string
+	allChannels  bool
+	chanPatterns []string
+}
+
+type aclLogEntry struct {
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	ctime      int64 // ms
+	updated    int64 // ms
+	clientInfo string
+	entryId    int64
+}
+
+type aclState struct {
+	users       map[string]*aclUser
+	defaultUser *aclUser
+	log         []*aclLogEntry // 新的记录在前面
+	nextLogId   int64
+}
+
+var acl aclState
+
+func hashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+func isValidPasswordHash(h string) bool {
+	if len(h) != 64 {
+		return false
+	}
+	for i := 0; i < len(h); i++ {
+		if !(h[i] >= '0' && h[i] <= '9') && !(h[i] >= 'a' && h[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newAclUser 新用户默认是禁用的，没有密码，不能执行任何命令
+func newAclUser(name string) *aclUser {
+	return &aclUser{
+		name:      name,
+		passwords: make(map[string]struct{}),
+		allowed:   make(map[string]bool),
+		cmdRules:  []string{"-@all"},
+	}
+}
+
+func aclCategoryByName(name string) (int, bool) {
+	for _, c := range aclCategoryNames {
+		if c.name == name {
+			return c.flag, true
+		}
+	}
+	return 0, false
+}
+
+// allCommands 返回所有命令以及子命令
+func allCommands() []*GoRedisCommand {
+	var cmds []*GoRedisCommand
+	for _, cmd := range sortedCommands() {
+		cmds = append(cmds, cmd)
+		for i := range cmd.subcommands {
+			cmds = append(cmds, &cmd.subcommands[i])
+		}
+	}
+	return cmds
+}
+
+// setCommandPerm 设置命令的权限，容器命令会同时设置所有子命令
+func (u *aclUser) setCommandPerm(cmd *GoRedisCommand, allow bool) {
+	u.allowed[cmd.fullName()] = allow
+	for i := range cmd.subcommands {
+		u.allowed[cmd.subcommands[i].fullName()] = allow
+	}
+}
+
+// setCommandRule 处理 +get -set +@read -@all +slowlog|get 形式的规则
+func (u *aclUser) setCommandRule(op string) error {
+	allow := op[0] == '+'
+	name := strings.ToLower(op[1:])
+	if name == "@all" {
+		for _, cmd := range allCommands() {
+			u.allowed[cmd.fullName()] = allow
+		}
+		// +@all 和 -@all 会覆盖之前所有的命令规则
+		u.cmdRules = []string{op[:1] + "@all"}
+		return nil
+	}
+	if strings.HasPrefix(name, "@") {
+		cat, ok := aclCategoryByName(name[1:])
+		if !ok {
+			return ErrAclUnknownCommand
+		}
+		for _, cmd := range allCommands() {
+			if cmd.allAclCategories()&cat != 0 {
+				u.allowed[cmd.fullName()] = allow
+			}
+		}
+	} else {
+		cmd := lookupCommandByName(name)
+		if cmd == nil {
+			return ErrAclUnknownCommand
+		}
+		u.setCommandPerm(cmd, allow)
+	}
+	u.cmdRules = append(u.cmdRules, op[:1]+name)
+	return nil
+}
+
+// SetRule 按照 ACL SETUSER 的规则修改用户
+func (u *aclUser) SetRule(op string) error {
+	if op == "" {
+		return ErrAclSyntax
+	}
+	switch strings.ToLower(op) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = make(map[string]struct{})
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = make(map[string]struct{})
+		return nil
+	case "allkeys", "~*":
+		u.allKeys = true
+		u.keyPatterns = nil
+		return nil
+	case "resetkeys":
+		u.allKeys = false
+		u.keyPatterns = nil
+		return nil
+	case "allchannels", "&*":
+		u.allChannels = true
+		u.chanPatterns = nil
+		return nil
+	case "resetchannels":
+		u.allChannels = false
+		u.chanPatterns = nil
+		return nil
+	case "allcommands":
+		return u.setCommandRule("+@all")
+	case "nocommands":
+		return u.setCommandRule("-@all")
+	case "reset":
+		*u = *newAclUser(u.name)
+		return nil
+	}
+	switch op[0] {
+	case '>':
+		u.passwords[hashPassword(op[1:])] = struct{}{}
+		u.nopass = false
+	case '<':
+		h := hashPassword(op[1:])
+		if _, ok := u.passwords[h]; !ok {
+			return ErrAclNoSuchPass
+		}
+		delete(u.passwords, h)
+	case '#':
+		if !isValidPasswordHash(op[1:]) {
+			return ErrAclBadHash
+		}
+		u.passwords[op[1:]] = struct{}{}
+		u.nopass = false
+	case '!':
+		if _, ok := u.passwords[op[1:]]; !ok {
+			return ErrAclNoSuchPass
+		}
+		delete(u.passwords, op[1:])
+	case '~':
+		if u.allKeys {
+			return ErrAclPatternAfterAll
+		}
+		u.keyPatterns = append(u.keyPatterns, op[1:])
+	case '&':
+		if u.allChannels {
+			return ErrAclPatternAfterAll
+		}
+		u.chanPatterns = append(u.chanPatterns, op[1:])
+	case '+', '-':
+		return u.setCommandRule(op)
+	default:
+		return ErrAclSyntax
+	}
+	return nil
+}
+
+// SetRules 依次应用多条规则，任何一条失败用户都不会被修改
+func (u *aclUser) SetRules(ops []string) error {
+	tmp := u.clone()
+	for _, op := range ops {
+		if err := tmp.SetRule(op); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %v", op, err)
+		}
+	}
+	*u = *tmp
+	return nil
+}
+
+func (u *aclUser) clone() *aclUser {
+	n := *u
+	n.passwords = make(map[string]struct{}, len(u.passwords))
+	for k := range u.passwords {
+		n.passwords[k] = struct{}{}
+	}
+	n.allowed = make(map[string]bool, len(u.allowed))
+	for k, v := range u.allowed {
+		n.allowed[k] = v
+	}
+	n.cmdRules = append([]string(nil), u.cmdRules...)
+	n.keyPatterns = append([]string(nil), u.keyPatterns...)
+	n.chanPatterns = append([]string(nil), u.chanPatterns...)
+	return &n
+}
+
+func (u *aclUser) checkPassword(pass string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	_, ok := u.passwords[hashPassword(pass)]
+	return ok
+}
+
+func (u *aclUser) flagNames() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) sortedPasswords() []string {
+	res := make([]string, 0, len(u.passwords))
+	for h := range u.passwords {
+		res = append(res, h)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (u *aclUser) keysDescr() string {
+	if u.allKeys {
+		return "~*"
+	}
+	res := make([]string, 0, len(u.keyPatterns))
+	for _, p := range u.keyPatterns {
+		res = append(res, "~"+p)
+	}
+	return strings.Join(res, " ")
+}
+
+func (u *aclUser) channelsDescr() string {
+	if u.allChannels {
+		return "&*"
+	}
+	res := make([]string, 0, len(u.chanPatterns))
+	for _, p := range u.chanPatterns {
+		res = append(res, "&"+p)
+	}
+	return strings.Join(res, " ")
+}
+
+// Descr 返回ACL LIST以及ACL文件中使用的用户描述
+func (u *aclUser) Descr() string {
+	parts := []string{"user", u.name}
+	parts = append(parts, u.flagNames()...)
+	for _, h := range u.sortedPasswords() {
+		parts = append(parts, "#"+h)
+	}
+	if keys := u.keysDescr(); keys != "" {
+		parts = append(parts, keys)
+	} else {
+		parts = append(parts, "resetkeys")
+	}
+	if channels := u.channelsDescr(); channels != "" {
+		parts = append(parts, channels)
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.cmdRules...)
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) keyAllowed(key string) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, p := range u.keyPatterns {
+		if stringMatch(p, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelAllowed 频道按照用户的模式匹配，频道模式（例如PSUBSCRIBE的参数）必须和用户的某个模式完全相同
+func (u *aclUser) channelAllowed(channel string, isPattern bool) bool {
+	if u.allChannels {
+		return true
+	}
+	for _, p := range u.chanPatterns {
+		if isPattern && p == channel {
+			return true
+		}
+		if !isPattern && stringMatch(p, channel, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclCheckAllPerm 检查用户是否能执行该命令，不能执行时返回拒绝的原因以及对象
+func aclCheckAllPerm(u *aclUser, cmd *GoRedisCommand, args []*GObj) (bool, string, string) {
+	// 不需要认证的命令（例如AUTH）也不受命令权限的限制
+	if cmd.flags&CMD_NO_AUTH == 0 && !u.allowed[cmd.fullName()] {
+		return false, ACL_DENIED_CMD, cmd.fullName()
+	}
+	for _, idx := range cmd.getKeys(len(args)) {
+		key := args[idx].StrVal()
+		if !u.keyAllowed(key) {
+			return false, ACL_DENIED_KEY, key
+		}
+	}
+	for _, cs := range cmd.channelSpecs {
+		for _, idx := range specIndexes(nil, cs.beginIndex, cs.lastChannel, cs.step, len(args)) {
+			channel := args[idx].StrVal()
+			if !u.channelAllowed(channel, cs.flags&CHANNEL_PATTERN != 0) {
+				return false, ACL_DENIED_CHANNEL, channel
+			}
+		}
+	}
+	return true, "", ""
+}
+
+// aclInit 创建default用户，然后应用配置文件中的user指令以及aclfile
+func aclInit(config *Config) error {
+	acl = aclState{users: make(map[string]*aclUser)}
+	def := newAclUser(ACL_DEFAULT_USER)
+	_ = def.SetRules([]string{"+@all", "~*", "&*", "on", "nopass"})
+	acl.users[def.name] = def
+	acl.defaultUser = def
+	if config.Requirepass != "" {
+		_ = def.SetRules([]string{"resetpass", ">" + config.Requirepass})
+	}
+	for _, rules := range config.Users {
+		u := aclGetOrCreateUser(rules[0])
+		if err := u.SetRules(rules[1:]); err != nil {
+			return err
+		}
+	}
+	if config.Aclfile != "" {
+		if _, err := os.Stat(config.Aclfile); err == nil {
+			return aclLoadFromFile(config.Aclfile, nil)
+		}
+	}
+	return nil
+}
+
+func aclGetOrCreateUser(name string) *aclUser {
+	u := acl.users[name]
+	if u == nil {
+		u = newAclUser(name)
+		acl.users[name] = u
+	}
+	return u
+}
+
+// authRequired default用户没有设置nopass或者被禁用时，新连接需要先认证
+func authRequired(c *GoRedisClient) bool {
+	def := acl.defaultUser
+	return def != nil && (!def.nopass || !def.enabled) && !c.authenticated
+}
+
+// aclAuthenticate 校验用户名密码，失败时记录到ACL LOG
+func aclAuthenticate(c *GoRedisClient, username, pass string) bool {
+	u := acl.users[username]
+	if u != nil && u.checkPassword(pass) {
+		c.user = u
+		c.authenticated = true
+		return true
+	}
+	addACLLogEntry(c, ACL_DENIED_AUTH, "toplevel", "AUTH", username)
+	return false
+}
+
+// addACLLogEntry 记录被拒绝的操作，短时间内相同的记录只增加计数
+func addACLLogEntry(c *GoRedisClient, reason, context, object, username string) {
+	maxLen := DEFAULT_ACLLOG_MAX_LEN
+	if server.config != nil {
+		maxLen = server.config.AcllogMaxLen
+	}
+	if username == "" {
+		username = c.username()
+	}
+	now := GetMsTime()
+	for _, e := range acl.log {
+		if e.reason == reason && e.context == context && e.object == object &&
+			e.username == username && now-e.updated < ACL_LOG_GROUPING_TIME {
+			e.count++
+			e.updated = now
+			e.clientInfo = catClientInfoString(c)
+			return
+		}
+	}
+	e := &aclLogEntry{
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		ctime:      now,
+		updated:    now,
+		clientInfo: catClientInfoString(c),
+		entryId:    acl.nextLogId,
+	}
+	acl.nextLogId++
+	acl.log = append([]*aclLogEntry{e}, acl.log...)
+	if len(acl.log) > maxLen {
+		acl.log = acl.log[:maxLen]
+	}
+}
+
+// aclLoadFromFile 加载用户文件，文件中有任何错误都不会修改当前的用户，
+// current是执行ACL LOAD的客户端，启动时为nil
+func aclLoadFromFile(path string, current *GoRedisClient) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		if len(args) < 2 || args[0] != "user" {
+			return fmt.Errorf("%s:%d: line should start with user keyword", path, lineNum)
+		}
+		if _, ok := users[args[1]]; ok {
+			return fmt.Errorf("%s:%d: duplicate user '%s' found", path, lineNum, args[1])
+		}
+		u := newAclUser(args[1])
+		if err = u.SetRules(args[2:]); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		users[u.name] = u
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	// 文件中没有default用户时保留当前的
+	if users[ACL_DEFAULT_USER] == nil {
+		users[ACL_DEFAULT_USER] = acl.defaultUser
+	}
+	acl.users = users
+	acl.defaultUser = users[ACL_DEFAULT_USER]
+	// 已认证的客户端切换到新的用户，用户已经不存在的断开连接
+	for _, c := range server.clients {
+		if c.user == nil {
+			continue
+		}
+		if u := users[c.user.name]; u != nil {
+			c.user = u
+		} else {
+			disconnectClient(c, current)
+		}
+	}
+	return nil
+}
+
+func aclSaveToFile(path string) error {
+	names := make([]string, 0, len(acl.users))
+	for name := range acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(acl.users[name].Descr())
+		b.WriteString("\n")
+	}
+	// 先写临时文件再rename，避免写到一半时文件损坏
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func authCommand(c *GoRedisClient) {
+	if len(c.args) > 3 {
+		c.AddReplyErrorObject(shared.syntaxErr)
+		return
+	}
+	username, pass := ACL_DEFAULT_USER, c.args[1].StrVal()
+	if len(c.args) == 3 {
+		username, pass = c.args[1].StrVal(), c.args[2].StrVal()
+	} else if acl.defaultUser.nopass {
+		c.AddReplyError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+	if aclAuthenticate(c, username, pass) {
+		c.AddReply(shared.ok)
+	} else {
+		c.AddReplyErrorObject(shared.wrongPassErr)
+	}
+}
+
+func addReplyStrings(c *GoRedisClient, strs []string) {
+	c.AddReplyArrayLen(len(strs))
+	for _, s := range strs {
+		c.AddReplyBulk(s)
+	}
+}
+
+func aclLogCommand(c *GoRedisClient) {
+	count := 10
+	if len(c.args) == 3 {
+		arg := c.args[2].StrVal()
+		if strings.EqualFold(arg, "reset") {
+			acl.log = nil
+			c.AddReply(shared.ok)
+			return
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
+		}
+		count = n
+	}
+	if count > len(acl.log) {
+		count = len(acl.log)
+	}
+	now := GetMsTime()
+	c.AddReplyArrayLen(count)
+	for _, e := range acl.log[:count] {
+		c.AddReplyMapLen(10)
+		c.AddReplyBulk("count")
+		c.AddReplyInt(int64(e.count))
+		c.AddReplyBulk("reason")
+		c.AddReplyBulk(e.reason)
+		c.AddReplyBulk("context")
+		c.AddReplyBulk(e.context)
+		c.AddReplyBulk("object")
+		c.AddReplyBulk(e.object)
+		c.AddReplyBulk("username")
+		c.AddReplyBulk(e.username)
+		c.AddReplyBulk("age-seconds")
+		c.AddReplyDouble(float64(now-e.ctime) / 1000)
+		c.AddReplyBulk("client-info")
+		c.AddReplyBulk(e.clientInfo)
+		c.AddReplyBulk("entry-id")
+		c.AddReplyInt(e.entryId)
+		c.AddReplyBulk("timestamp-created")
+		c.AddReplyInt(e.ctime)
+		c.AddReplyBulk("timestamp-last-updated")
+		c.AddReplyInt(e.updated)
+	}
+}
+
+func aclCommand(c *GoRedisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch sub {
+	case "setuser":
+		name := c.args[2].StrVal()
+		u := acl.users[name]
+		if u == nil {
+			u = newAclUser(name)
+		}
+		ops := make([]string, 0, len(c.args)-3)
+		for _, arg := range c.args[3:] {
+			ops = append(ops, arg.StrVal())
+		}
+		if err := u.SetRules(ops); err != nil {
+			c.AddReplyError(err.Error())
+			return
+		}
+		acl.users[name] = u
+		c.AddReply(shared.ok)
+	case "getuser":
+		u := acl.users[c.args[2].StrVal()]
+		if u == nil {
+			c.AddReplyNull()
+			return
+		}
+		c.AddReplyMapLen(6)
+		c.AddReplyBulk("flags")
+		addReplyStrings(c, u.flagNames())
+		c.AddReplyBulk("passwords")
+		addReplyStrings(c, u.sortedPasswords())
+		c.AddReplyBulk("commands")
+		c.AddReplyBulk(strings.Join(u.cmdRules, " "))
+		c.AddReplyBulk("keys")
+		c.AddReplyBulk(u.keysDescr())
+		c.AddReplyBulk("channels")
+		c.AddReplyBulk(u.channelsDescr())
+		c.AddReplyBulk("selectors")
+		c.AddReplyArrayLen(0)
+	case "deluser":
+		var deleted int64
+		for _, arg := range c.args[2:] {
+			name := arg.StrVal()
+			if name == ACL_DEFAULT_USER {
+				c.AddReplyError("The 'default' user cannot be removed")
+				return
+			}
+		}
+		for _, arg := range c.args[2:] {
+			u := acl.users[arg.StrVal()]
+			if u == nil {
+				continue
+			}
+			delete(acl.users, u.name)
+			deleted++
+			// 断开使用该用户认证的连接
+			for _, other := range server.clients {
+				if other.user == u {
+					disconnectClient(other, c)
+				}
+			}
+		}
+		c.AddReplyInt(deleted)
+	case "list", "users":
+		names := make([]string, 0, len(acl.users))
+		for name := range acl.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if sub == "list" {
+			for i, name := range names {
+				names[i] = acl.users[name].Descr()
+			}
+		}
+		addReplyStrings(c, names)
+	case "whoami":
+		c.AddReplyBulk(c.username())
+	case "cat":
+		if len(c.args) == 2 {
+			names := make([]string, 0, len(aclCategoryNames))
+			for _, cat := range aclCategoryNames {
+				names = append(names, cat.name)
+			}
+			addReplyStrings(c, names)
+			return
+		}
+		cat, ok := aclCategoryByName(strings.ToLower(c.args[2].StrVal()))
+		if !ok {
+			c.AddReplyErrorFormat("Unknown category '%s'", c.args[2].StrVal())
+			return
+		}
+		var names []string
+		for _, cmd := range allCommands() {
+			if cmd.proc != nil && cmd.allAclCategories()&cat != 0 {
+				names = append(names, cmd.fullName())
+			}
+		}
+		addReplyStrings(c, names)
+	case "log":
+		aclLogCommand(c)
+	case "save", "load":
+		if server.config == nil || server.config.Aclfile == "" {
+			c.AddReplyError("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+			return
+		}
+		var err error
+		if sub == "save" {
+			err = aclSaveToFile(server.config.Aclfile)
+		} else {
+			err = aclLoadFromFile(server.config.Aclfile, c)
+		}
+		if err != nil {
+			c.AddReplyError(err.Error())
+			return
+		}
+		c.AddReply(shared.ok)
+	case "help":
+		help := []string{
+			"ACL <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CAT [<category>]",
+			"    List all commands that belong to <category>, or all command categories",
+			"    when no category is specified.",
+			"DELUSER <username> [<username> ...]",
+			"    Delete a list of users.",
+			"GETUSER <username>",
+			"    Get the user's details.",
+			"LIST",
+			"    Show users details in config file format.",
+			"LOAD",
+			"    Reload users from the ACL file.",
+			"LOG [<count> | RESET]",
+			"    Show the ACL log entries.",
+			"SAVE",
+			"    Save the current config to the ACL file.",
+			"SETUSER <username> <attribute> [<attribute> ...]",
+			"    Create or modify a user with the specified attributes.",
+			"USERS",
+			"    List all the registered usernames.",
+			"WHOAMI",
+			"    Return the current connection username.",
+		}
+		c.AddReplyHelp(help)
+	}
+}
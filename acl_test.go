@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestAclUserRules(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	u := newAclUser("alice")
+	assert.Nil(t, u.SetRules([]string{"on", ">pw", "~user:*", "+@read", "-info", "+slowlog|len"}))
+	assert.True(t, u.checkPassword("pw"))
+	assert.False(t, u.checkPassword("other"))
+
+	get := lookupCommand("get")
+	args := []*GObj{CreateObject(GSTR, "get"), CreateObject(GSTR, "user:1")}
+	ok, _, _ := aclCheckAllPerm(u, get, args)
+	assert.True(t, ok)
+	args[1] = CreateObject(GSTR, "admin:1")
+	ok, reason, object := aclCheckAllPerm(u, get, args)
+	assert.False(t, ok)
+	assert.Equal(t, ACL_DENIED_KEY, reason)
+	assert.Equal(t, "admin:1", object)
+
+	ok, reason, _ = aclCheckAllPerm(u, lookupCommand("set"), args)
+	assert.False(t, ok)
+	assert.Equal(t, ACL_DENIED_CMD, reason)
+	assert.True(t, u.allowed["slowlog|len"])
+	assert.False(t, u.allowed["slowlog|get"])
+
+	// 任何一条规则出错都不会修改用户
+	err := u.SetRules([]string{"off", "+nosuchcommand"})
+	assert.NotNil(t, err)
+	assert.True(t, u.enabled)
+
+	assert.Nil(t, u.SetRule("reset"))
+	assert.False(t, u.enabled)
+	assert.False(t, u.checkPassword("pw"))
+}
+
+func TestAclAuth(t *testing.T) {
+	conf := Config{Requirepass: "secret", AcllogMaxLen: 10}
+	initServer(&conf)
+	client := CreateClient(server.ipfd[0])
+	ReadQuery(client, "get k\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	assert.Equal(t, "-NOAUTH Authentication required.\r\n", takeReply(client))
+
+	ReadQuery(client, "auth wrong\r\nauth wrong\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	assert.Equal(t, 1, len(acl.log))
+	assert.Equal(t, 2, acl.log[0].count)
+	assert.Equal(t, ACL_DENIED_AUTH, acl.log[0].reason)
+
+	ReadQuery(client, "auth secret\r\nget k\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	assert.True(t, strings.HasSuffix(takeReply(client), "+OK\r\n$-1\r\n"))
+}
+
+func TestAclFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	conf := Config{Aclfile: path}
+	initServer(&conf)
+	u := aclGetOrCreateUser("bob")
+	assert.Nil(t, u.SetRules([]string{"on", "nopass", "allkeys", "+@all", "-set"}))
+	assert.Nil(t, aclSaveToFile(path))
+
+	assert.Nil(t, os.WriteFile(path+".bad", []byte("user bob on +nosuch\n"), 0644))
+	assert.NotNil(t, aclLoadFromFile(path+".bad", nil))
+
+	delete(acl.users, "bob")
+	assert.Nil(t, aclLoadFromFile(path, nil))
+	bob := acl.users["bob"]
+	assert.NotNil(t, bob)
+	assert.Equal(t, "user bob on nopass ~* resetchannels +@all -set", bob.Descr())
+}
+
+func TestAclDeluserSelf(t *testing.T) {
+	var conf Config
+	assert.Nil(t, initServer(&conf))
+	defer closeListeningSockets()
+	c, peer := newTestClientPair(t, "127.0.0.1:1000")
+	ReadQuery(c, "acl setuser bob on >pw ~* +@all\r\nauth bob pw\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.Equal(t, "+OK\r\n+OK\r\n", takeReply(c))
+
+	// 删除自己使用的用户时仍然收到回复，回复发送完之后连接被关闭
+	ReadQuery(c, "acl deluser bob\r\nget k\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	beforeSleep(server.aeLoop)
+	buf := make([]byte, 64)
+	n, err := unix.Read(peer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, ":1\r\n", string(buf[:n]))
+	assert.NotZero(t, c.flags&CLIENT_CLOSED)
+	assert.NotContains(t, server.clientList, c)
+}
+
+func TestAclChannels(t *testing.T) {
+	conf := Config{AcllogMaxLen: 10}
+	initServer(&conf)
+	// 模拟发布订阅类的命令，频道参数由channelSpecs描述
+	publish := &GoRedisCommand{
+		name: "publish", arity: 3, flags: CMD_PUBSUB | CMD_FAST,
+		proc:         func(c *GoRedisClient) { c.AddReplyInt(0) },
+		channelSpecs: []channelSpec{{beginIndex: 1, lastChannel: 0, step: 1}},
+	}
+	psubscribe := &GoRedisCommand{
+		name: "psubscribe", arity: -2, flags: CMD_PUBSUB,
+		channelSpecs: []channelSpec{{flags: CHANNEL_PATTERN, beginIndex: 1, lastChannel: -1, step: 1}},
+	}
+	server.commands[publish.name] = publish
+	server.commands[psubscribe.name] = psubscribe
+
+	u := newAclUser("alice")
+	assert.Nil(t, u.SetRules([]string{"on", "nopass", "+@all", "&news.*"}))
+	args := func(strs ...string) []*GObj {
+		res := make([]*GObj, len(strs))
+		for i, s := range strs {
+			res[i] = CreateObject(GSTR, s)
+		}
+		return res
+	}
+	ok, _, _ := aclCheckAllPerm(u, publish, args("publish", "news.sport", "hi"))
+	assert.True(t, ok)
+	ok, reason, object := aclCheckAllPerm(u, publish, args("publish", "admin", "hi"))
+	assert.False(t, ok)
+	assert.Equal(t, ACL_DENIED_CHANNEL, reason)
+	assert.Equal(t, "admin", object)
+	// 模式必须和用户的模式完全相同，news.* 不能订阅更宽的 *
+	ok, _, _ = aclCheckAllPerm(u, psubscribe, args("psubscribe", "news.*"))
+	assert.True(t, ok)
+	ok, _, object = aclCheckAllPerm(u, psubscribe, args("psubscribe", "news.*", "*"))
+	assert.False(t, ok)
+	assert.Equal(t, "*", object)
+	assert.Nil(t, u.SetRule("allchannels"))
+	ok, _, _ = aclCheckAllPerm(u, psubscribe, args("psubscribe", "*"))
+	assert.True(t, ok)
+	assert.Nil(t, u.SetRule("resetchannels"))
+	ok, _, _ = aclCheckAllPerm(u, publish, args("publish", "news.sport", "hi"))
+	assert.False(t, ok)
+
+	// ProcessCommand 拒绝访问并记录ACL LOG
+	client := CreateClient(server.ipfd[0])
+	ReadQuery(client, "acl setuser bob on >pw +@all &news.*\r\nauth bob pw\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	assert.Equal(t, "+OK\r\n+OK\r\n", takeReply(client))
+	ReadQuery(client, "publish news.sport hi\r\npublish admin hi\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	assert.Equal(t, ":0\r\n-NOPERM No permissions to access a channel\r\n", takeReply(client))
+	assert.Equal(t, ACL_DENIED_CHANNEL, acl.log[0].reason)
+	assert.Equal(t, "admin", acl.log[0].object)
+}
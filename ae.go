@@ -1,10 +1,10 @@
 package main
 
 import (
+	"container/heap"
+	"fmt"
 	"log"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 type FeType int
@@ -13,6 +13,9 @@ type FeType int
 const (
 	AE_READABLE FeType = 1
 	AE_WRITABLE FeType = 2
+	// AE_BARRIER 和AE_WRITABLE一起使用，同一轮中先调用可写回调再调用可读回调，
+	// 例如需要先把数据落盘再回复的场景
+	AE_BARRIER FeType = 4
 )
 
 type TeType int
@@ -24,35 +27,100 @@ const (
 
 type FileProc func(loop *AeLoop, fd int, extra interface{})
 type TimeProc func(loop *AeLoop, id int, extra interface{})
+type BeforeSleepProc func(loop *AeLoop)
+type AfterSleepProc func(loop *AeLoop)
 
 type AeFileEvent struct {
-	fd    int
-	mask  FeType
-	proc  FileProc
-	extra interface{}
+	fd      int
+	mask    FeType
+	proc    FileProc
+	extra   interface{}
+	barrier bool // 可写事件设置了AE_BARRIER
 }
 
 type AeTimeEvent struct {
 	id       int
 	mask     TeType // 源码用的与运算所以用mask，这里只用简单的比较
-	when     int64  // ms 发生时间点
+	when     int64  // ms 发生时间点，单调时钟，不受系统时间调整的影响
 	interval int64  // ms 发生间隔
 	proc     TimeProc
 	extra    interface{}
-	next     *AeTimeEvent
+	index    int  // 在堆中的位置，不在堆中时为-1
+	deleted  bool // 已经被删除，AeProcess中还没有处理的事件需要跳过
+}
+
+// timeEventHeap 按照when排序的最小堆，when相同时先添加的先执行
+type timeEventHeap []*AeTimeEvent
+
+func (h timeEventHeap) Len() int { return len(h) }
+
+func (h timeEventHeap) Less(i, j int) bool {
+	if h[i].when != h[j].when {
+		return h[i].when < h[j].when
+	}
+	return h[i].id < h[j].id
+}
+
+func (h timeEventHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timeEventHeap) Push(x interface{}) {
+	te := x.(*AeTimeEvent)
+	te.index = len(*h)
+	*h = append(*h, te)
+}
+
+func (h *timeEventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	te := old[n-1]
+	old[n-1] = nil
+	te.index = -1
+	*h = old[:n-1]
+	return te
+}
+
+// PollEvent 就绪的fd，mask中出错和挂断已经转换成了可读可写
+type PollEvent struct {
+	fd   int
+	mask FeType
+}
+
+// Poller IO多路复用的后端，对应redis中的ae_epoll.c、ae_select.c等，
+// mask只包含AE_READABLE和AE_WRITABLE，timeout单位是ms
+type Poller interface {
+	Add(fd int, mask FeType) error
+	Modify(fd int, mask FeType) error
+	Delete(fd int) error
+	Wait(timeout int64) ([]PollEvent, error)
+	Name() string
+}
+
+// NewPoller 根据名字创建后端，为空时使用epoll
+func NewPoller(name string) (Poller, error) {
+	switch name {
+	case "", "epoll":
+		return newEpollPoller()
+	case "poll":
+		return newPollPoller()
+	}
+	return nil, fmt.Errorf("unknown poller %v", name)
 }
 
 type AeLoop struct {
 	FileEvents      map[int]*AeFileEvent // 在client注册和销毁是都要使用到，方便进行添加和销魂
-	TimeEvents      *AeTimeEvent         // 使用的链表结构
-	fileEventFd     int
+	TimeEvents      timeEventHeap        // 最小堆，添加和删除都是O(log n)
+	timeEventIndex  map[int]*AeTimeEvent // id到事件，删除时不需要遍历
+	poller          Poller
 	timeEventNextId int
+	beforeSleep     []BeforeSleepProc // 每次等待事件之前按照注册的顺序调用
+	afterSleep      []AfterSleepProc  // 等待返回之后、处理事件之前调用
 	stop            bool
 }
 
-// ae常量到epoll的映射，readable映射EPOLLIN，writeable映射EPOLLOUT
-var fe2ep = [3]uint32{0, unix.EPOLLIN, unix.EPOLLOUT}
-
 // 把fd和事件压缩成一个key，例如那个fd可读
 func getFeKey(fd int, mask FeType) int {
 	if mask == AE_READABLE {
@@ -62,63 +130,62 @@ func getFeKey(fd int, mask FeType) int {
 	}
 }
 
-// getEpollMask 获得已经绑定的事件
-func (loop *AeLoop) getEpollMask(fd int) uint32 {
-	var ev uint32
+// getFileMask 获得已经绑定的事件
+func (loop *AeLoop) getFileMask(fd int) FeType {
+	var ev FeType
 	// 检测A事件可读这个是否已经绑定，没有就添加
 	if loop.FileEvents[getFeKey(fd, AE_READABLE)] != nil {
-		ev |= fe2ep[AE_READABLE]
+		ev |= AE_READABLE
 	}
 	if loop.FileEvents[getFeKey(fd, AE_WRITABLE)] != nil {
-		ev |= fe2ep[AE_WRITABLE]
+		ev |= AE_WRITABLE
 	}
 	return ev
 }
 
 func (loop *AeLoop) AddFileEvent(fd int, mask FeType, proc FileProc, extra interface{}) {
+	barrier := mask&AE_BARRIER != 0
+	mask &= ^AE_BARRIER
 	// 获取已经绑定的事件
-	ev := loop.getEpollMask(fd)
+	ev := loop.getFileMask(fd)
 	// 如果已经订阅过,返回
-	if ev&fe2ep[mask] != 0 {
+	if ev&mask != 0 {
 		return
 	}
-	op := unix.EPOLL_CTL_ADD
-	if ev != 0 {
-		op = unix.EPOLL_CTL_MOD
-	}
+	var err error
 	// 或操作相当于增加了一种类型操作
-	// ev是对应epoll_in,epoll_out
-	ev |= fe2ep[mask]
-	// 订阅回调事件，第一个fd用的是创建的epollfd
-	if err := unix.EpollCtl(loop.fileEventFd, op, fd,
-		&unix.EpollEvent{Fd: int32(fd), Events: ev}); err != nil {
-		log.Printf("epoll ctr err: %v\n", err)
+	if ev == 0 {
+		err = loop.poller.Add(fd, ev|mask)
+	} else {
+		err = loop.poller.Modify(fd, ev|mask)
+	}
+	if err != nil {
+		log.Printf("%v ctl err: %v\n", loop.poller.Name(), err)
 		return
 	}
 	// 创建ae事件
 	fe := AeFileEvent{
-		fd:    fd,
-		mask:  mask, // readable or writeable
-		proc:  proc, // 事件的处理
-		extra: extra,
+		fd:      fd,
+		mask:    mask, // readable or writeable
+		proc:    proc, // 事件的处理
+		extra:   extra,
+		barrier: barrier && mask == AE_WRITABLE,
 	}
 	loop.FileEvents[getFeKey(fd, mask)] = &fe
 	log.Printf("ae add file event fd:%v, mask:%v\n", fd, mask)
 }
 
 func (loop *AeLoop) RemoveFileEvent(fd int, mask FeType) {
-	op := unix.EPOLL_CTL_DEL
-	ev := loop.getEpollMask(fd)
 	// 相当于摘除操作
-	ev &= ^fe2ep[mask]
-	if ev != 0 {
-		op = unix.EPOLL_CTL_MOD
+	ev := loop.getFileMask(fd) & ^mask
+	var err error
+	if ev == 0 {
+		err = loop.poller.Delete(fd)
+	} else {
+		err = loop.poller.Modify(fd, ev)
 	}
-	if err := unix.EpollCtl(loop.fileEventFd, op, fd, &unix.EpollEvent{
-		Fd:     int32(fd),
-		Events: ev,
-	}); err != nil {
-		log.Printf("epoll del err: %v\n", err)
+	if err != nil {
+		log.Printf("%v del err: %v\n", loop.poller.Name(), err)
 	}
 	delete(loop.FileEvents, getFeKey(fd, mask))
 	log.Printf("ae remove file event fd:%v, mask:%v\n", fd, mask)
@@ -129,130 +196,165 @@ func GetMsTime() int64 {
 	return time.Now().UnixNano() / 1e6
 }
 
+// 单调时钟的起点，time.Since使用的是单调时钟的读数
+var monotonicStart = time.Now()
+
+// getMonotonicMs 单调递增的毫秒数，时间事件用它调度，修改系统时间不会让定时器提前或者推迟
+func getMonotonicMs() int64 {
+	return int64(time.Since(monotonicStart) / time.Millisecond)
+}
+
 func (loop *AeLoop) AddTimeEvent(mask TeType, interval int64, proc TimeProc, extra interface{}) int {
 	id := loop.timeEventNextId
 	loop.timeEventNextId++
-	te := AeTimeEvent{
+	te := &AeTimeEvent{
 		id:       id,
 		mask:     mask,
 		interval: interval,
-		when:     GetMsTime() + interval,
+		when:     getMonotonicMs() + interval,
 		proc:     proc,
 		extra:    extra,
-		next:     loop.TimeEvents,
 	}
-	// 头插入
-	loop.TimeEvents = &te
+	heap.Push(&loop.TimeEvents, te)
+	loop.timeEventIndex[id] = te
 	return id
 }
 
+// RemoveTimeEvent 从堆中删除事件，已经到期、正在AeProcess中等待执行的事件只做标记
 func (loop *AeLoop) RemoveTimeEvent(id int) {
-	p := loop.TimeEvents
-	var pre *AeTimeEvent
-	for p != nil {
-		if p.id == id {
-			if pre == nil {
-				loop.TimeEvents = p.next
-			} else {
-				pre.next = p.next
-			}
-			p.next = nil
-			break
-		}
-		pre = p
-		p = p.next
+	te := loop.timeEventIndex[id]
+	if te == nil {
+		return
+	}
+	delete(loop.timeEventIndex, id)
+	te.deleted = true
+	if te.index >= 0 {
+		heap.Remove(&loop.TimeEvents, te.index)
 	}
 }
 
+// AeLoopCreate 使用默认的epoll创建事件循环
 func AeLoopCreate() (*AeLoop, error) {
-	epollFd, err := unix.EpollCreate1(0)
+	poller, err := newEpollPoller()
 	if err != nil {
 		return nil, err
 	}
+	return AeLoopCreateWithPoller(poller), nil
+}
+
+// AeLoopCreateWithPoller 指定IO多路复用的后端，测试中可以传入假的实现
+func AeLoopCreateWithPoller(poller Poller) *AeLoop {
 	return &AeLoop{
 		FileEvents:      make(map[int]*AeFileEvent),
-		fileEventFd:     epollFd,
+		timeEventIndex:  make(map[int]*AeTimeEvent),
+		poller:          poller,
 		timeEventNextId: 1,
 		stop:            false,
-	}, nil
+	}
 }
 
+// nearestTime 最近的时间事件发生的时间点(单调时钟)，没有时间事件时最多等1s
 func (loop *AeLoop) nearestTime() int64 {
-	var nearest = GetMsTime() + 1000
-	p := loop.TimeEvents
-	for p != nil {
-		if p.when < nearest {
-			nearest = p.when
-		}
-		p = p.next
+	nearest := getMonotonicMs() + 1000
+	if len(loop.TimeEvents) > 0 && loop.TimeEvents[0].when < nearest {
+		nearest = loop.TimeEvents[0].when
 	}
 	return nearest
 }
 
 func (loop *AeLoop) AeWait() (tes []*AeTimeEvent, fes []*AeFileEvent) {
 	// loop.nearestTime() 求出等待io事件的最长时间，最长不能超过当前时间+1s，最短是10ms
-	timeout := loop.nearestTime() - GetMsTime()
+	timeout := loop.nearestTime() - getMonotonicMs()
 	if timeout <= 0 {
 		timeout = 10
 	}
-	// 收集所有的网络事件fd
-	var events [128]unix.EpollEvent
-	// 等待事件时间不能超过下一个时间事件到来之前
-	n, err := unix.EpollWait(loop.fileEventFd, events[:], int(timeout))
+	// 收集所有的网络事件fd，等待事件时间不能超过下一个时间事件到来之前
+	events, err := loop.poller.Wait(timeout)
 	if err != nil {
-		log.Printf("epoll wait warning: %v\n", err)
+		log.Printf("%v wait warning: %v\n", loop.poller.Name(), err)
 	}
-	if n > 0 {
-		log.Printf("ae get %v epoll events\n", n)
+	for _, proc := range loop.afterSleep {
+		proc(loop)
 	}
-	// 收集所有file events
-	for i := 0; i < n; i++ {
-		var mask FeType
-		if events[i].Events&unix.EPOLLIN != 0 {
-			mask = AE_READABLE
-		} else if events[i].Events&unix.EPOLLOUT != 0 {
-			mask = AE_WRITABLE
-		} else {
-			continue
+	if len(events) > 0 {
+		log.Printf("ae get %v %v events\n", len(events), loop.poller.Name())
+	}
+	// 收集所有file events，可读可写同时就绪时两个回调都要执行
+	for _, ev := range events {
+		fd, mask := ev.fd, ev.mask
+		var rfe, wfe *AeFileEvent
+		if mask&AE_READABLE != 0 {
+			rfe = loop.FileEvents[getFeKey(fd, AE_READABLE)]
 		}
-		feKey := getFeKey(int(events[i].Fd), mask)
-		if fe := loop.FileEvents[feKey]; fe != nil {
-			fes = append(fes, fe)
+		if mask&AE_WRITABLE != 0 {
+			wfe = loop.FileEvents[getFeKey(fd, AE_WRITABLE)]
 		}
-	}
-	// 找出所有到点的事件
-	now := GetMsTime()
-	p := loop.TimeEvents
-	for p != nil {
-		if p.when <= now {
-			tes = append(tes, p)
+		// 通常先读后写，这样处理完请求之后可以马上把回复写出去，设置了barrier时反过来
+		if wfe != nil && wfe.barrier {
+			rfe, wfe = wfe, rfe
+		}
+		if rfe != nil {
+			fes = append(fes, rfe)
 		}
-		p = p.next
+		if wfe != nil {
+			fes = append(fes, wfe)
+		}
+	}
+	// 从堆顶取出所有到点的事件，周期事件在AeProcess中重新放回堆中
+	now := getMonotonicMs()
+	for len(loop.TimeEvents) > 0 && loop.TimeEvents[0].when <= now {
+		tes = append(tes, heap.Pop(&loop.TimeEvents).(*AeTimeEvent))
 	}
 	return
 }
 
 func (loop *AeLoop) AeProcess(tes []*AeTimeEvent, fes []*AeFileEvent) {
 	for _, te := range tes {
+		// 同一批中前面的回调可能已经删除了这个事件
+		if te.deleted {
+			continue
+		}
 		te.proc(loop, te.id, te.extra)
-		// 如果该事件时间只执行一次，马上移除
-		if te.mask == AE_ONCE {
+		// 如果该事件时间只执行一次，或者在回调中删除了自己，不再放回堆中
+		if te.mask == AE_ONCE || te.deleted {
 			loop.RemoveTimeEvent(te.id)
 		} else {
 			// 更新下次发生的时间点
-			te.when = GetMsTime() + te.interval
+			te.when = getMonotonicMs() + te.interval
+			heap.Push(&loop.TimeEvents, te)
 		}
 	}
 	if len(fes) > 0 {
 		log.Println("ae is processing file events")
 		for _, fe := range fes {
+			// 同一批中前面的回调可能已经删除了这个事件，或者关闭fd之后又被新的连接复用
+			if loop.FileEvents[getFeKey(fe.fd, fe.mask)] != fe {
+				continue
+			}
 			fe.proc(loop, fe.fd, fe.extra)
 		}
 	}
 }
 
+// AddBeforeSleepProc 注册每次进入等待之前的回调，例如写出回复、处理解除阻塞的客户端
+func (loop *AeLoop) AddBeforeSleepProc(proc BeforeSleepProc) {
+	loop.beforeSleep = append(loop.beforeSleep, proc)
+}
+
+// AddAfterSleepProc 注册等待返回之后的回调，在AeWait中执行，早于所有的文件事件和时间事件
+func (loop *AeLoop) AddAfterSleepProc(proc AfterSleepProc) {
+	loop.afterSleep = append(loop.afterSleep, proc)
+}
+
 func (loop *AeLoop) AeMain() {
 	for !loop.stop {
+		for _, proc := range loop.beforeSleep {
+			proc(loop)
+			// beforeSleep中可能已经完成了SHUTDOWN
+			if loop.stop {
+				return
+			}
+		}
 		// 收集所有的事件
 		tes, fes := loop.AeWait()
 		loop.AeProcess(tes, fes)
@@ -0,0 +1,75 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// AE_EPOLL_MAX_EVENTS 每次epoll_wait最多返回的事件数，剩下的下一轮再取
+const AE_EPOLL_MAX_EVENTS int = 128
+
+// epollPoller 对应redis的ae_epoll.c，默认的实现
+type epollPoller struct {
+	epfd   int
+	events [AE_EPOLL_MAX_EVENTS]unix.EpollEvent
+}
+
+func newEpollPoller() (Poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epollPoller{epfd: epfd}, nil
+}
+
+// maskToEpoll ae事件到epoll的映射，readable映射EPOLLIN，writeable映射EPOLLOUT
+func maskToEpoll(mask FeType) uint32 {
+	var ev uint32
+	if mask&AE_READABLE != 0 {
+		ev |= unix.EPOLLIN
+	}
+	if mask&AE_WRITABLE != 0 {
+		ev |= unix.EPOLLOUT
+	}
+	return ev
+}
+
+// epollToMask 出错或者对端挂断时可读和可写都通知，由回调在读写时发现错误并释放连接
+func epollToMask(events uint32) FeType {
+	var mask FeType
+	if events&unix.EPOLLIN != 0 {
+		mask |= AE_READABLE
+	}
+	if events&unix.EPOLLOUT != 0 {
+		mask |= AE_WRITABLE
+	}
+	if events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+		mask |= AE_READABLE | AE_WRITABLE
+	}
+	return mask
+}
+
+func (p *epollPoller) Add(fd int, mask FeType) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: maskToEpoll(mask)})
+}
+
+func (p *epollPoller) Modify(fd int, mask FeType) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: maskToEpoll(mask)})
+}
+
+func (p *epollPoller) Delete(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, &unix.EpollEvent{Fd: int32(fd)})
+}
+
+func (p *epollPoller) Wait(timeout int64) ([]PollEvent, error) {
+	n, err := unix.EpollWait(p.epfd, p.events[:], int(timeout))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]PollEvent, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, PollEvent{fd: int(p.events[i].Fd), mask: epollToMask(p.events[i].Events)})
+	}
+	return events, nil
+}
+
+func (p *epollPoller) Name() string {
+	return "epoll"
+}
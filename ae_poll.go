@@ -0,0 +1,90 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// pollPoller 基于poll(2)的实现，不依赖epoll，每次等待的开销和fd的数量成正比
+type pollPoller struct {
+	fds   []unix.PollFd
+	index map[int]int // fd在fds中的位置
+}
+
+func newPollPoller() (Poller, error) {
+	return &pollPoller{index: make(map[int]int)}, nil
+}
+
+func maskToPoll(mask FeType) int16 {
+	var ev int16
+	if mask&AE_READABLE != 0 {
+		ev |= unix.POLLIN
+	}
+	if mask&AE_WRITABLE != 0 {
+		ev |= unix.POLLOUT
+	}
+	return ev
+}
+
+// pollToMask 和epoll一样，出错或者挂断时可读和可写都通知
+func pollToMask(revents int16) FeType {
+	var mask FeType
+	if revents&unix.POLLIN != 0 {
+		mask |= AE_READABLE
+	}
+	if revents&unix.POLLOUT != 0 {
+		mask |= AE_WRITABLE
+	}
+	if revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0 {
+		mask |= AE_READABLE | AE_WRITABLE
+	}
+	return mask
+}
+
+func (p *pollPoller) Add(fd int, mask FeType) error {
+	if _, ok := p.index[fd]; ok {
+		return unix.EEXIST
+	}
+	p.index[fd] = len(p.fds)
+	p.fds = append(p.fds, unix.PollFd{Fd: int32(fd), Events: maskToPoll(mask)})
+	return nil
+}
+
+func (p *pollPoller) Modify(fd int, mask FeType) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	p.fds[i].Events = maskToPoll(mask)
+	return nil
+}
+
+// Delete 把最后一个fd挪到被删除的位置
+func (p *pollPoller) Delete(fd int) error {
+	i, ok := p.index[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	last := len(p.fds) - 1
+	p.fds[i] = p.fds[last]
+	p.index[int(p.fds[i].Fd)] = i
+	p.fds = p.fds[:last]
+	delete(p.index, fd)
+	return nil
+}
+
+func (p *pollPoller) Wait(timeout int64) ([]PollEvent, error) {
+	n, err := unix.Poll(p.fds, int(timeout))
+	if err != nil || n <= 0 {
+		return nil, err
+	}
+	events := make([]PollEvent, 0, n)
+	for i := range p.fds {
+		if p.fds[i].Revents == 0 {
+			continue
+		}
+		events = append(events, PollEvent{fd: int(p.fds[i].Fd), mask: pollToMask(p.fds[i].Revents)})
+	}
+	return events, nil
+}
+
+func (p *pollPoller) Name() string {
+	return "poll"
+}
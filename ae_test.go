@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func WriteProc(loop *AeLoop, fd int, extra interface{}) {
@@ -30,7 +31,7 @@ func ReadProc(loop *AeLoop, fd int, extra interface{}) {
 }
 
 func AcceptProc(loop *AeLoop, fd int, extra interface{}) {
-	cfd, err := Accept(fd)
+	cfd, _, err := Accept(fd)
 	if err != nil {
 		fmt.Printf("accept err: %v\n", err)
 		return
@@ -53,12 +54,12 @@ func NormalProc(loop *AeLoop, id int, extra interface{}) {
 func TestAe(t *testing.T) {
 	loop, err := AeLoopCreate()
 	assert.Nil(t, err)
-	sfd, err := TcpServer(6666)
+	sfd, err := TcpServer("*", 6666)
 	assert.Nil(t, err)
 	loop.AddFileEvent(sfd, AE_READABLE, AcceptProc, nil)
 	go loop.AeMain()
 	// init client & test file events
-	host := [4]byte{0, 0, 0, 0}
+	host := "0.0.0.0"
 	cfd, err := Connect(host, 6666)
 	assert.Nil(t, err)
 	msg := "helloworld"
@@ -78,3 +79,258 @@ func TestAe(t *testing.T) {
 	<-end
 	loop.stop = true
 }
+
+func TestTimeEventHeap(t *testing.T) {
+	loop, err := AeLoopCreate()
+	assert.Nil(t, err)
+	var fired []int
+	record := func(loop *AeLoop, id int, extra interface{}) {
+		fired = append(fired, id)
+	}
+	// 倒序添加，按照到期时间执行
+	ids := make([]int, 0, 1000)
+	for i := 1000; i > 0; i-- {
+		ids = append(ids, loop.AddTimeEvent(AE_ONCE, int64(i), record, nil))
+	}
+	assert.Equal(t, int64(1), loop.TimeEvents[0].interval)
+	// 删除一半之后堆仍然有序
+	for i := 0; i < len(ids); i += 2 {
+		loop.RemoveTimeEvent(ids[i])
+	}
+	assert.Equal(t, 500, len(loop.TimeEvents))
+	for _, te := range loop.TimeEvents {
+		te.when -= 2000
+	}
+	tes, _ := loop.AeWait()
+	assert.Equal(t, 500, len(tes))
+	for i := 1; i < len(tes); i++ {
+		assert.True(t, tes[i-1].when <= tes[i].when)
+	}
+	loop.AeProcess(tes, nil)
+	assert.Equal(t, 500, len(fired))
+	assert.Equal(t, 0, len(loop.TimeEvents))
+	assert.Equal(t, 0, len(loop.timeEventIndex))
+
+	// 同一批中的回调删除后面的事件以及自己
+	fired = nil
+	var second int
+	first := loop.AddTimeEvent(AE_NORMAL, 0, func(loop *AeLoop, id int, extra interface{}) {
+		fired = append(fired, id)
+		loop.RemoveTimeEvent(second)
+		loop.RemoveTimeEvent(id)
+	}, nil)
+	second = loop.AddTimeEvent(AE_ONCE, 0, record, nil)
+	normal := loop.AddTimeEvent(AE_NORMAL, 0, record, nil)
+	loop.AeProcess(loop.AeWait())
+	assert.Equal(t, []int{first, normal}, fired)
+	// 周期事件重新放回堆中
+	assert.Equal(t, 1, len(loop.TimeEvents))
+	assert.Equal(t, normal, loop.TimeEvents[0].id)
+	assert.True(t, loop.nearestTime() <= getMonotonicMs())
+}
+
+func TestFileEventDispatch(t *testing.T) {
+	loop, err := AeLoopCreate()
+	assert.Nil(t, err)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer unix.Close(fds[1])
+	var fired []string
+	record := func(name string) FileProc {
+		return func(loop *AeLoop, fd int, extra interface{}) {
+			fired = append(fired, name)
+		}
+	}
+
+	// 可读可写同时就绪时两个回调都执行，默认先读后写
+	fd := fds[0]
+	loop.AddFileEvent(fd, AE_READABLE, record("r"), nil)
+	loop.AddFileEvent(fd, AE_WRITABLE, record("w"), nil)
+	_, err = Write(fds[1], []byte("x"))
+	assert.Nil(t, err)
+	loop.AeProcess(loop.AeWait())
+	assert.Equal(t, []string{"r", "w"}, fired)
+
+	// 设置barrier之后先写后读
+	fired = nil
+	loop.RemoveFileEvent(fd, AE_WRITABLE)
+	loop.AddFileEvent(fd, AE_WRITABLE|AE_BARRIER, record("w"), nil)
+	loop.AeProcess(loop.AeWait())
+	assert.Equal(t, []string{"w", "r"}, fired)
+
+	// 出错或者挂断时只注册了可读事件也会通知
+	fired = nil
+	loop.RemoveFileEvent(fd, AE_WRITABLE)
+	unix.Read(fd, make([]byte, 1))
+	unix.Close(fds[1])
+	loop.AeProcess(loop.AeWait())
+	assert.Equal(t, []string{"r"}, fired)
+	loop.RemoveFileEvent(fd, AE_READABLE)
+	unix.Close(fd)
+}
+
+// fakePoller 只在内存中记录注册的事件，就绪事件由测试注入，返回的顺序是确定的
+type fakePoller struct {
+	masks map[int]FeType
+	ready []PollEvent
+}
+
+func newFakePoller() *fakePoller {
+	return &fakePoller{masks: make(map[int]FeType)}
+}
+
+func (p *fakePoller) Add(fd int, mask FeType) error {
+	if _, ok := p.masks[fd]; ok {
+		return unix.EEXIST
+	}
+	p.masks[fd] = mask
+	return nil
+}
+
+func (p *fakePoller) Modify(fd int, mask FeType) error {
+	if _, ok := p.masks[fd]; !ok {
+		return unix.ENOENT
+	}
+	p.masks[fd] = mask
+	return nil
+}
+
+func (p *fakePoller) Delete(fd int) error {
+	if _, ok := p.masks[fd]; !ok {
+		return unix.ENOENT
+	}
+	delete(p.masks, fd)
+	return nil
+}
+
+func (p *fakePoller) Wait(timeout int64) ([]PollEvent, error) {
+	events := p.ready
+	p.ready = nil
+	return events, nil
+}
+
+func (p *fakePoller) Name() string {
+	return "fake"
+}
+
+// inject 下一次Wait返回fd就绪，和真正的后端一样不检查是否注册过
+func (p *fakePoller) inject(fd int, mask FeType) {
+	p.ready = append(p.ready, PollEvent{fd: fd, mask: mask})
+}
+
+func TestFakePoller(t *testing.T) {
+	poller := newFakePoller()
+	loop := AeLoopCreateWithPoller(poller)
+	var fired []string
+	record := func(name string) FileProc {
+		return func(loop *AeLoop, fd int, extra interface{}) {
+			fired = append(fired, fmt.Sprintf("%v%v", name, fd))
+		}
+	}
+	loop.AddFileEvent(1, AE_READABLE, record("r"), nil)
+	loop.AddFileEvent(1, AE_WRITABLE, record("w"), nil)
+	loop.AddFileEvent(2, AE_WRITABLE|AE_BARRIER, record("w"), nil)
+	loop.AddFileEvent(2, AE_READABLE, record("r"), nil)
+	assert.Equal(t, map[int]FeType{1: AE_READABLE | AE_WRITABLE, 2: AE_READABLE | AE_WRITABLE}, poller.masks)
+
+	// 按照注入的顺序执行，同一个fd默认先读后写，barrier先写后读，只注册了的事件才会执行
+	loop.AddFileEvent(3, AE_READABLE, record("r"), nil)
+	poller.inject(2, AE_READABLE|AE_WRITABLE)
+	poller.inject(1, AE_READABLE|AE_WRITABLE)
+	poller.inject(3, AE_READABLE|AE_WRITABLE)
+	poller.inject(4, AE_READABLE)
+	loop.AeProcess(loop.AeWait())
+	assert.Equal(t, []string{"w2", "r2", "r1", "w1", "r3"}, fired)
+
+	// 同一批中前面的回调删除了后面的事件，或者关闭fd之后被新的连接复用
+	fired = nil
+	loop.RemoveFileEvent(1, AE_READABLE)
+	loop.AddFileEvent(1, AE_READABLE, func(loop *AeLoop, fd int, extra interface{}) {
+		fired = append(fired, "r1")
+		loop.RemoveFileEvent(2, AE_READABLE)
+		loop.RemoveFileEvent(2, AE_WRITABLE)
+		loop.RemoveFileEvent(3, AE_READABLE)
+		loop.AddFileEvent(3, AE_READABLE, record("new"), nil)
+		loop.RemoveFileEvent(1, AE_WRITABLE)
+	}, nil)
+	poller.inject(1, AE_READABLE|AE_WRITABLE)
+	poller.inject(2, AE_READABLE)
+	poller.inject(3, AE_READABLE)
+	loop.AeProcess(loop.AeWait())
+	assert.Equal(t, []string{"r1"}, fired)
+	assert.Equal(t, map[int]FeType{1: AE_READABLE, 3: AE_READABLE}, poller.masks)
+	loop.RemoveFileEvent(4, AE_READABLE)
+}
+
+// TestPollers 真正的后端在socketpair上的表现一致
+func TestPollers(t *testing.T) {
+	assert.Equal(t, AE_READABLE|AE_WRITABLE, epollToMask(unix.EPOLLERR))
+	assert.Equal(t, AE_READABLE|AE_WRITABLE, pollToMask(unix.POLLHUP))
+	_, err := NewPoller("select")
+	assert.NotNil(t, err)
+	for _, name := range []string{"epoll", "poll"} {
+		poller, err := NewPoller(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, poller.Name())
+		var fds [2][2]int
+		for i := range fds {
+			fds[i], err = unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, poller.Add(fds[0][0], AE_READABLE|AE_WRITABLE))
+		assert.Nil(t, poller.Add(fds[1][0], AE_READABLE))
+		assert.NotNil(t, poller.Add(fds[1][0], AE_READABLE))
+		events, err := poller.Wait(0)
+		assert.Nil(t, err)
+		assert.Equal(t, []PollEvent{{fds[0][0], AE_WRITABLE}}, events, name)
+
+		_, err = Write(fds[1][1], []byte("x"))
+		assert.Nil(t, err)
+		assert.Nil(t, poller.Modify(fds[0][0], AE_READABLE))
+		events, err = poller.Wait(100)
+		assert.Nil(t, err)
+		assert.Equal(t, []PollEvent{{fds[1][0], AE_READABLE}}, events, name)
+
+		// 删除之后不再通知，对端关闭时可读可写都通知
+		assert.Nil(t, poller.Delete(fds[1][0]))
+		assert.NotNil(t, poller.Delete(fds[1][0]))
+		unix.Close(fds[0][1])
+		events, err = poller.Wait(100)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(events), name)
+		assert.Equal(t, fds[0][0], events[0].fd)
+		assert.Equal(t, AE_READABLE|AE_WRITABLE, events[0].mask, name)
+		unix.Close(fds[0][0])
+		unix.Close(fds[1][0])
+		unix.Close(fds[1][1])
+	}
+}
+
+func TestSleepProcs(t *testing.T) {
+	poller := newFakePoller()
+	loop := AeLoopCreateWithPoller(poller)
+	var fired []string
+	loop.AddFileEvent(1, AE_READABLE, func(loop *AeLoop, fd int, extra interface{}) {
+		fired = append(fired, "file")
+	}, nil)
+	// 按照注册的顺序在等待之前执行，第二次进入时停止事件循环
+	loop.AddBeforeSleepProc(func(loop *AeLoop) {
+		fired = append(fired, "before1")
+		poller.inject(1, AE_READABLE)
+	})
+	loop.AddBeforeSleepProc(func(loop *AeLoop) {
+		fired = append(fired, "before2")
+		if len(fired) > 2 {
+			loop.stop = true
+		}
+	})
+	loop.AddBeforeSleepProc(func(loop *AeLoop) {
+		fired = append(fired, "before3")
+	})
+	// 等待返回之后，处理文件事件之前执行
+	loop.AddAfterSleepProc(func(loop *AeLoop) {
+		fired = append(fired, "after")
+	})
+	loop.AeMain()
+	assert.Equal(t, []string{"before1", "before2", "before3", "after", "file", "before1", "before2"}, fired)
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CLIENT PAUSE 暂停的范围
+const (
+	CLIENT_PAUSE_OFF   int = 0
+	CLIENT_PAUSE_WRITE int = 1 // 只暂停写命令
+	CLIENT_PAUSE_ALL   int = 2
+)
+
+// 暂停的来源，每个来源分别记录暂停的范围和结束时间，实际生效的是其中最严格的
+const (
+	PAUSE_BY_CLIENT_COMMAND int = iota // CLIENT PAUSE
+	PAUSE_DURING_SHUTDOWN              // 关闭时等待回复发送完的期间
+	NUM_PAUSE_PURPOSES
+)
+
+type clientPause struct {
+	typ int   // CLIENT_PAUSE_*
+	end int64 // ms
+}
+
+var errSyntax = errors.New("syntax error")
+
+// clientFlagNames CLIENT LIST 中flags字段使用的字符
+var clientFlagNames = []struct {
+	flag int
+	name byte
+}{
+	{CLIENT_MONITOR, 'O'},
+	{CLIENT_REPLICA, 'S'},
+	{CLIENT_MASTER, 'M'},
+	{CLIENT_PUBSUB, 'P'},
+	{CLIENT_BLOCKED, 'b'},
+	{CLIENT_CLOSE_AFTER_REPLY, 'c'},
+	{CLIENT_CLOSE_ASAP, 'A'},
+	{CLIENT_NO_EVICT, 'e'},
+	{CLIENT_UNIX_SOCKET, 'U'},
+}
+
+// argvMemory 当前命令参数占用的内存
+func (c *GoRedisClient) argvMemory() int {
+	n := 0
+	for _, arg := range c.args {
+		n += len(arg.StrVal())
+	}
+	return n
+}
+
+// catClientInfoString 生成 CLIENT LIST 中一个客户端的描述，字段和redis保持一致
+func catClientInfoString(c *GoRedisClient) string {
+	var flags []byte
+	for _, f := range clientFlagNames {
+		if c.flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	if len(flags) == 0 {
+		flags = append(flags, 'N')
+	}
+	events := ""
+	if server.aeLoop != nil {
+		if server.aeLoop.FileEvents[getFeKey(c.fd, AE_READABLE)] != nil {
+			events += "r"
+		}
+		if server.aeLoop.FileEvents[getFeKey(c.fd, AE_WRITABLE)] != nil {
+			events += "w"
+		}
+	}
+	cmd := "NULL"
+	if c.lastCmd != nil {
+		cmd = c.lastCmd.fullName()
+	}
+	// 普通连接这两项为空
+	tlsVersion, tlsCipher := "", ""
+	if c.tls != nil {
+		tlsVersion, tlsCipher = c.tls.versionName(), c.tls.cipherName()
+	}
+	now := time.Now().Unix()
+	qbuf := c.queryLen - c.qbPos
+	argvMem := c.argvMemory()
+	totMem := len(c.queryBuf) + cap(c.buf) + int(c.replyBytes) + argvMem
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=0 sub=0 psub=0 ssub=0 "+
+		"multi=-1 qbuf=%d qbuf-free=%d argv-mem=%d multi-mem=0 obl=%d oll=%d omem=%d tot-mem=%d "+
+		"events=%s cmd=%s user=%s redir=-1 resp=%d tls-version=%s tls-cipher=%s",
+		c.id, c.addr, c.laddr, c.fd, c.name, now-c.ctime, now-c.lastInteraction, flags,
+		qbuf, len(c.queryBuf)-c.queryLen, argvMem, len(c.buf), len(c.reply), c.replyBytes, totMem,
+		events, cmd, c.username(), c.resp, tlsVersion, tlsCipher)
+}
+
+// clientFilter CLIENT LIST 和 CLIENT KILL 的过滤条件，零值表示不过滤
+type clientFilter struct {
+	ids    map[int64]bool
+	addr   string
+	laddr  string
+	user   string
+	typ    int // -1 表示不过滤
+	skipme bool
+}
+
+func (f *clientFilter) match(c, current *GoRedisClient) bool {
+	if len(f.ids) > 0 && !f.ids[c.id] {
+		return false
+	}
+	if f.addr != "" && f.addr != c.addr {
+		return false
+	}
+	if f.laddr != "" && f.laddr != c.laddr {
+		return false
+	}
+	if f.user != "" && f.user != c.username() {
+		return false
+	}
+	if f.typ >= 0 && f.typ != getClientType(c) {
+		return false
+	}
+	if f.skipme && c == current {
+		return false
+	}
+	return true
+}
+
+// parseClientFilter 解析 <filter> <value> 对，ID可以跟多个id，allowSkipme只有KILL支持
+func parseClientFilter(args []*GObj, allowSkipme bool) (*clientFilter, error) {
+	f := &clientFilter{typ: -1, skipme: allowSkipme}
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToLower(args[i].StrVal())
+		if i+1 >= len(args) {
+			return nil, errSyntax
+		}
+		switch {
+		case opt == "id":
+			f.ids = make(map[int64]bool)
+			// LIST 的 ID 后面可以跟多个id，KILL 只有一个
+			for i+1 < len(args) {
+				id, err := strconv.ParseInt(args[i+1].StrVal(), 10, 64)
+				if err != nil || id <= 0 {
+					if len(f.ids) == 0 {
+						return nil, errors.New("Invalid client ID")
+					}
+					break
+				}
+				f.ids[id] = true
+				i++
+				if allowSkipme {
+					break
+				}
+			}
+			continue
+		case opt == "type":
+			f.typ = getClientTypeByName(args[i+1].StrVal())
+			if f.typ < 0 {
+				return nil, fmt.Errorf("Unknown client type '%s'", args[i+1].StrVal())
+			}
+		case opt == "addr":
+			f.addr = args[i+1].StrVal()
+		case opt == "laddr":
+			f.laddr = args[i+1].StrVal()
+		case opt == "user":
+			u := acl.users[args[i+1].StrVal()]
+			if u == nil {
+				return nil, fmt.Errorf("No such user '%s'", args[i+1].StrVal())
+			}
+			f.user = u.name
+		case opt == "skipme" && allowSkipme:
+			switch strings.ToLower(args[i+1].StrVal()) {
+			case "yes":
+				f.skipme = true
+			case "no":
+				f.skipme = false
+			default:
+				return nil, errSyntax
+			}
+		default:
+			return nil, errSyntax
+		}
+		i++
+	}
+	return f, nil
+}
+
+// pauseActions 按照来源暂停到end(ms)，同一个来源已经在暂停时取更严格的范围和更晚的结束时间
+func pauseActions(purpose int, end int64, typ int) {
+	p := &server.clientPauses[purpose]
+	if typ > p.typ {
+		p.typ = typ
+	}
+	if end > p.end {
+		p.end = end
+	}
+	updatePausedActions()
+}
+
+// unpauseActions 结束这个来源的暂停，其他来源的暂停仍然有效
+func unpauseActions(purpose int) {
+	server.clientPauses[purpose] = clientPause{}
+	updatePausedActions()
+}
+
+// updatePausedActions 重新计算生效的暂停，范围变小时被推迟的客户端在beforeSleep中重新执行，
+// 仍然需要暂停的命令会再次被推迟
+func updatePausedActions() {
+	prev := server.clientPauseType
+	server.clientPauseType = CLIENT_PAUSE_OFF
+	server.clientPauseEndTime = 0
+	for _, p := range server.clientPauses {
+		if p.typ > server.clientPauseType {
+			server.clientPauseType = p.typ
+		}
+		if p.typ != CLIENT_PAUSE_OFF && p.end > server.clientPauseEndTime {
+			server.clientPauseEndTime = p.end
+		}
+	}
+	if server.clientPauseType < prev {
+		server.unblockedClients = append(server.unblockedClients, server.pausedClients...)
+		server.pausedClients = nil
+	}
+}
+
+// checkClientPauseTimeout 暂停时间到了自动恢复
+func checkClientPauseTimeout() {
+	now := GetMsTime()
+	for purpose, p := range server.clientPauses {
+		if p.typ != CLIENT_PAUSE_OFF && now >= p.end {
+			unpauseActions(purpose)
+		}
+	}
+}
+
+// shouldPauseCommand 暂停期间是否推迟执行这个命令，CLIENT命令本身不暂停，否则没有办法UNPAUSE
+func shouldPauseCommand(c *GoRedisClient, cmd *GoRedisCommand) bool {
+	if server.clientPauseType == CLIENT_PAUSE_OFF || c.flags&CLIENT_REPLICA != 0 {
+		return false
+	}
+	top := cmd
+	if top.parent != nil {
+		top = top.parent
+	}
+	if top.name == "client" {
+		return false
+	}
+	return server.clientPauseType == CLIENT_PAUSE_ALL || cmd.flags&CMD_WRITE != 0
+}
+
+// blockPostponeClient 推迟执行客户端已经解析好的命令，期间不再处理它后续的请求
+func blockPostponeClient(c *GoRedisClient) {
+	c.flags |= CLIENT_BLOCKED
+	server.pausedClients = append(server.pausedClients, c)
+}
+
+// processUnblockedClients 重新执行被推迟的命令，然后继续处理已经读到的请求
+func processUnblockedClients() {
+	for len(server.unblockedClients) > 0 {
+		c := server.unblockedClients[0]
+		server.unblockedClients = server.unblockedClients[1:]
+		if c.flags&CLIENT_CLOSED != 0 {
+			continue
+		}
+		c.flags &= ^CLIENT_BLOCKED
+		// 被推迟的命令重新执行，SHUTDOWN失败的客户端已经回复过了，只需要继续处理后面的请求
+		if len(c.args) > 0 {
+			ProcessCommand(c)
+			if c.flags&(CLIENT_BLOCKED|CLIENT_CLOSED) != 0 {
+				continue
+			}
+		}
+		if err := ProcessQueryBuf(c); err != nil {
+			setProtocolError(c, err)
+		}
+	}
+}
+
+var clientHelp = []string{
+	"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"GETNAME",
+	"    Return the name of the current connection.",
+	"ID",
+	"    Return the ID of the current connection.",
+	"INFO",
+	"    Return information about the current client connection.",
+	"KILL <ip:port>",
+	"    Kill connection made from <ip:port>.",
+	"KILL <option> <value> [<option> <value> [...]]",
+	"    Kill connections. Options are:",
+	"    * ADDR (<ip:port>|<unixsocket>:0)",
+	"      Kill connections made from the specified address",
+	"    * LADDR (<ip:port>|<unixsocket>:0)",
+	"      Kill connections made to specified local address",
+	"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+	"      Kill connections by type.",
+	"    * USER <username>",
+	"      Kill connections authenticated by <username>.",
+	"    * SKIPME (YES|NO)",
+	"      Skip killing current connection (default: yes).",
+	"    * ID <client-id>",
+	"      Kill connections by client id.",
+	"LIST [options ...]",
+	"    Return information about client connections. Options:",
+	"    * TYPE (NORMAL|MASTER|REPLICA|PUBSUB)",
+	"      Return clients of specified type.",
+	"    * ID <client-id> [<client-id> ...]",
+	"      Return clients of specified IDs only.",
+	"    * ADDR, LADDR, USER",
+	"      Same as for CLIENT KILL.",
+	"PAUSE <timeout> [WRITE|ALL]",
+	"    Suspend all, or just write, clients for <timeout> milliseconds.",
+	"UNPAUSE",
+	"    Stop the current client pause, resuming traffic.",
+	"SETNAME <name>",
+	"    Assign the name <name> to the current connection.",
+	"REPLY (ON|OFF|SKIP)",
+	"    Control the replies sent to the current connection.",
+	"NO-EVICT (ON|OFF)",
+	"    Protect current client connection from eviction.",
+	"HELP",
+	"    Print this help.",
+}
+
+// clientCommand CLIENT 子命令
+func clientCommand(c *GoRedisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch sub {
+	case "id":
+		c.AddReplyInt(c.id)
+	case "info":
+		c.AddReplyVerbatim(catClientInfoString(c)+"\n", "txt")
+	case "list":
+		f, err := parseClientFilter(c.args[2:], false)
+		if err != nil {
+			c.AddReplyError(err.Error())
+			return
+		}
+		var b strings.Builder
+		for _, other := range server.clientList {
+			if f.match(other, c) {
+				b.WriteString(catClientInfoString(other))
+				b.WriteByte('\n')
+			}
+		}
+		c.AddReplyVerbatim(b.String(), "txt")
+	case "kill":
+		clientKillCommand(c)
+	case "setname":
+		name := c.args[2].StrVal()
+		if !validClientName(name) {
+			c.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+			return
+		}
+		c.name = name
+		c.AddReply(shared.ok)
+	case "getname":
+		if c.name == "" {
+			c.AddReplyNull()
+		} else {
+			c.AddReplyBulk(c.name)
+		}
+	case "pause":
+		timeout, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+		if err != nil || timeout < 0 {
+			c.AddReplyError("timeout is not an integer or out of range")
+			return
+		}
+		typ := CLIENT_PAUSE_ALL
+		if len(c.args) == 4 {
+			switch strings.ToLower(c.args[3].StrVal()) {
+			case "write":
+				typ = CLIENT_PAUSE_WRITE
+			case "all":
+			default:
+				c.AddReplyError("CLIENT PAUSE mode must be WRITE or ALL")
+				return
+			}
+		}
+		pauseActions(PAUSE_BY_CLIENT_COMMAND, GetMsTime()+timeout, typ)
+		c.AddReply(shared.ok)
+	case "unpause":
+		unpauseActions(PAUSE_BY_CLIENT_COMMAND)
+		c.AddReply(shared.ok)
+	case "reply":
+		switch strings.ToLower(c.args[2].StrVal()) {
+		case "on":
+			c.flags &= ^(CLIENT_REPLY_OFF | CLIENT_REPLY_SKIP_NEXT)
+			c.AddReply(shared.ok)
+		case "off":
+			c.flags |= CLIENT_REPLY_OFF
+		case "skip":
+			if c.flags&CLIENT_REPLY_OFF == 0 {
+				c.flags |= CLIENT_REPLY_SKIP_NEXT
+			}
+		default:
+			c.AddReplyErrorObject(shared.syntaxErr)
+		}
+	case "no-evict":
+		switch strings.ToLower(c.args[2].StrVal()) {
+		case "on":
+			c.flags |= CLIENT_NO_EVICT
+			c.AddReply(shared.ok)
+		case "off":
+			c.flags &= ^CLIENT_NO_EVICT
+			c.AddReply(shared.ok)
+		default:
+			c.AddReplyErrorObject(shared.syntaxErr)
+		}
+	case "help":
+		c.AddReplyHelp(clientHelp)
+	}
+}
+
+// clientKillCommand CLIENT KILL addr:port 或者 CLIENT KILL <filter> <value> ...
+// 杀掉自己时由disconnectClient推迟到回复发送完之后关闭
+func clientKillCommand(c *GoRedisClient) {
+	// 老的格式只有一个地址，找不到时报错
+	if len(c.args) == 3 {
+		found := false
+		for _, other := range server.clientList {
+			if other.addr == c.args[2].StrVal() {
+				disconnectClient(other, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.AddReplyError("No such client")
+			return
+		}
+		c.AddReply(shared.ok)
+	} else {
+		f, err := parseClientFilter(c.args[2:], true)
+		if err != nil {
+			c.AddReplyError(err.Error())
+			return
+		}
+		killed := 0
+		for _, other := range server.clientList {
+			if f.match(other, c) && other.flags&(CLIENT_CLOSE_ASAP|CLIENT_CLOSED) == 0 {
+				disconnectClient(other, c)
+				killed++
+			}
+		}
+		c.AddReplyInt(int64(killed))
+	}
+}
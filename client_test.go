@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// newTestClient 用socketpair创建一个已经注册的客户端
+func newTestClient(t *testing.T, addr string) *GoRedisClient {
+	c, _ := newTestClientPair(t, addr)
+	return c
+}
+
+// newTestClientPair 同时返回socketpair的另一端，用来检查真正写出去的回复
+func newTestClientPair(t *testing.T, addr string) (*GoRedisClient, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	t.Cleanup(func() { unix.Close(fds[1]) })
+	c := CreateClient(fds[0])
+	c.addr = addr
+	linkClient(c)
+	return c, fds[1]
+}
+
+func TestClientCommand(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	a := newTestClient(t, "127.0.0.1:1000")
+	b := newTestClient(t, "127.0.0.1:2000")
+
+	ReadQuery(a, "client setname app\r\nclient getname\r\nclient setname \"a b\"\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.Equal(t, "+OK\r\n$3\r\napp\r\n-ERR Client names cannot contain spaces, newlines or special characters.\r\n", takeReply(a))
+
+	ReadQuery(b, "get k\r\nclient list\r\n")
+	assert.Nil(t, ProcessQueryBuf(b))
+	list := takeReply(b)
+	assert.Contains(t, list, "addr=127.0.0.1:1000 ")
+	assert.Contains(t, list, " name=app ")
+	assert.Contains(t, list, " cmd=client|list ")
+
+	ReadQuery(b, "client list id "+strconv.FormatInt(a.id, 10)+"\r\n")
+	assert.Nil(t, ProcessQueryBuf(b))
+	list = takeReply(b)
+	assert.Contains(t, list, "addr=127.0.0.1:1000 ")
+	assert.NotContains(t, list, "addr=127.0.0.1:2000 ")
+
+	// REPLY SKIP只跳过下一条命令，REPLY OFF一直不回复
+	ReadQuery(a, "client reply skip\r\nget k\r\nget k\r\nclient reply off\r\nget k\r\nclient reply on\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.Equal(t, "$-1\r\n+OK\r\n", takeReply(a))
+
+	// PAUSE WRITE期间写命令被推迟，读命令照常执行
+	ReadQuery(a, "client pause 100000 write\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.Equal(t, "+OK\r\n", takeReply(a))
+	ReadQuery(b, "set k v\r\nget k\r\n")
+	assert.Nil(t, ProcessQueryBuf(b))
+	assert.NotZero(t, b.flags&CLIENT_BLOCKED)
+	assert.Equal(t, "", takeReply(b))
+	beforeSleep(server.aeLoop)
+	assert.NotZero(t, b.flags&CLIENT_BLOCKED)
+	ReadQuery(a, "get k\r\nclient unpause\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.Equal(t, "$-1\r\n+OK\r\n", takeReply(a))
+	processUnblockedClients()
+	assert.Zero(t, b.flags&CLIENT_BLOCKED)
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n", takeReply(b))
+
+	ReadQuery(a, "client kill 127.0.0.1:9999\r\nclient kill addr 127.0.0.1:2000 skipme yes\r\nclient kill id 1 foo\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.Equal(t, "-ERR No such client\r\n:1\r\n-ERR syntax error\r\n", takeReply(a))
+	assert.NotZero(t, b.flags&CLIENT_CLOSE_ASAP)
+	freeClientsInAsyncFreeQueue()
+	assert.Equal(t, []*GoRedisClient{a}, server.clientList)
+	freeClient(a)
+}
+
+func TestClientKillSelf(t *testing.T) {
+	var conf Config
+	assert.Nil(t, initServer(&conf))
+	defer closeListeningSockets()
+	a, peerA := newTestClientPair(t, "127.0.0.1:1000")
+	b, peerB := newTestClientPair(t, "127.0.0.1:2000")
+	c, _ := newTestClientPair(t, "127.0.0.1:3000")
+	buf := make([]byte, 64)
+
+	// 旧格式杀掉自己，回复发出去之后关闭连接，后面的命令不再执行
+	ReadQuery(a, "client kill 127.0.0.1:1000\r\nget k\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	beforeSleep(server.aeLoop)
+	n, err := unix.Read(peerA, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", string(buf[:n]))
+	assert.NotZero(t, a.flags&CLIENT_CLOSED)
+
+	// SKIPME NO 时自己也会被杀掉
+	ReadQuery(b, "client kill addr 127.0.0.1:2000 skipme no\r\n")
+	assert.Nil(t, ProcessQueryBuf(b))
+	beforeSleep(server.aeLoop)
+	n, err = unix.Read(peerB, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, ":1\r\n", string(buf[:n]))
+	assert.NotZero(t, b.flags&CLIENT_CLOSED)
+
+	// 没有回复时也会被关闭
+	ReadQuery(c, "client reply off\r\nclient kill id "+strconv.FormatInt(c.id, 10)+" skipme no\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	beforeSleep(server.aeLoop)
+	assert.NotZero(t, c.flags&CLIENT_CLOSED)
+	assert.Equal(t, 0, len(server.clientList))
+}
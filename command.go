@@ -0,0 +1,457 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// 命令标志
+const (
+	CMD_WRITE        int = 1 << 0  // 会修改数据
+	CMD_READONLY     int = 1 << 1  // 只读
+	CMD_DENYOOM      int = 1 << 2  // 内存超限时拒绝执行
+	CMD_ADMIN        int = 1 << 3  // 管理类命令
+	CMD_PUBSUB       int = 1 << 4  // 发布订阅相关
+	CMD_NOSCRIPT     int = 1 << 5  // 不能在脚本中执行
+	CMD_BLOCKING     int = 1 << 6  // 可能阻塞客户端
+	CMD_LOADING      int = 1 << 7  // 加载数据时也允许执行
+	CMD_STALE        int = 1 << 8  // 从库数据过期时也允许执行
+	CMD_SKIP_MONITOR int = 1 << 9  // 不推送给MONITOR，例如包含密码的命令
+	CMD_SKIP_SLOWLOG int = 1 << 10 // 不记录slowlog
+	CMD_FAST         int = 1 << 11 // O(1)或O(log(N))的命令
+	CMD_NO_AUTH      int = 1 << 12 // 未认证时也允许执行
+)
+
+var cmdFlagNames = []struct {
+	flag int
+	name string
+}{
+	{CMD_WRITE, "write"},
+	{CMD_READONLY, "readonly"},
+	{CMD_DENYOOM, "denyoom"},
+	{CMD_ADMIN, "admin"},
+	{CMD_PUBSUB, "pubsub"},
+	{CMD_NOSCRIPT, "noscript"},
+	{CMD_BLOCKING, "blocking"},
+	{CMD_LOADING, "loading"},
+	{CMD_STALE, "stale"},
+	{CMD_SKIP_MONITOR, "skip_monitor"},
+	{CMD_SKIP_SLOWLOG, "skip_slowlog"},
+	{CMD_FAST, "fast"},
+	{CMD_NO_AUTH, "no_auth"},
+}
+
+// ACL分类
+const (
+	ACL_CATEGORY_KEYSPACE    int = 1 << 0
+	ACL_CATEGORY_READ        int = 1 << 1
+	ACL_CATEGORY_WRITE       int = 1 << 2
+	ACL_CATEGORY_SET         int = 1 << 3
+	ACL_CATEGORY_SORTEDSET   int = 1 << 4
+	ACL_CATEGORY_LIST        int = 1 << 5
+	ACL_CATEGORY_HASH        int = 1 << 6
+	ACL_CATEGORY_STRING      int = 1 << 7
+	ACL_CATEGORY_BITMAP      int = 1 << 8
+	ACL_CATEGORY_HYPERLOGLOG int = 1 << 9
+	ACL_CATEGORY_GEO         int = 1 << 10
+	ACL_CATEGORY_STREAM      int = 1 << 11
+	ACL_CATEGORY_PUBSUB      int = 1 << 12
+	ACL_CATEGORY_ADMIN       int = 1 << 13
+	ACL_CATEGORY_FAST        int = 1 << 14
+	ACL_CATEGORY_SLOW        int = 1 << 15
+	ACL_CATEGORY_BLOCKING    int = 1 << 16
+	ACL_CATEGORY_DANGEROUS   int = 1 << 17
+	ACL_CATEGORY_CONNECTION  int = 1 << 18
+	ACL_CATEGORY_TRANSACTION int = 1 << 19
+	ACL_CATEGORY_SCRIPTING   int = 1 << 20
+)
+
+var aclCategoryNames = []struct {
+	flag int
+	name string
+}{
+	{ACL_CATEGORY_KEYSPACE, "keyspace"},
+	{ACL_CATEGORY_READ, "read"},
+	{ACL_CATEGORY_WRITE, "write"},
+	{ACL_CATEGORY_SET, "set"},
+	{ACL_CATEGORY_SORTEDSET, "sortedset"},
+	{ACL_CATEGORY_LIST, "list"},
+	{ACL_CATEGORY_HASH, "hash"},
+	{ACL_CATEGORY_STRING, "string"},
+	{ACL_CATEGORY_BITMAP, "bitmap"},
+	{ACL_CATEGORY_HYPERLOGLOG, "hyperloglog"},
+	{ACL_CATEGORY_GEO, "geo"},
+	{ACL_CATEGORY_STREAM, "stream"},
+	{ACL_CATEGORY_PUBSUB, "pubsub"},
+	{ACL_CATEGORY_ADMIN, "admin"},
+	{ACL_CATEGORY_FAST, "fast"},
+	{ACL_CATEGORY_SLOW, "slow"},
+	{ACL_CATEGORY_BLOCKING, "blocking"},
+	{ACL_CATEGORY_DANGEROUS, "dangerous"},
+	{ACL_CATEGORY_CONNECTION, "connection"},
+	{ACL_CATEGORY_TRANSACTION, "transaction"},
+	{ACL_CATEGORY_SCRIPTING, "scripting"},
+}
+
+// key spec 标志
+const (
+	KSPEC_RO     int = 1 << 0 // 只读
+	KSPEC_RW     int = 1 << 1 // 读写
+	KSPEC_OW     int = 1 << 2 // 覆盖写
+	KSPEC_RM     int = 1 << 3 // 删除
+	KSPEC_ACCESS int = 1 << 4 // 会返回key的值
+	KSPEC_UPDATE int = 1 << 5 // 更新已有的值
+	KSPEC_INSERT int = 1 << 6 // 新增值
+	KSPEC_DELETE int = 1 << 7 // 删除值
+)
+
+var keySpecFlagNames = []struct {
+	flag int
+	name string
+}{
+	{KSPEC_RO, "RO"},
+	{KSPEC_RW, "RW"},
+	{KSPEC_OW, "OW"},
+	{KSPEC_RM, "RM"},
+	{KSPEC_ACCESS, "access"},
+	{KSPEC_UPDATE, "update"},
+	{KSPEC_INSERT, "insert"},
+	{KSPEC_DELETE, "delete"},
+}
+
+// keySpec 描述key在参数中的位置，从beginIndex开始，
+// 到beginIndex+lastKey结束，lastKey为负数时从参数末尾往前数
+type keySpec struct {
+	flags      int
+	beginIndex int
+	lastKey    int
+	keyStep    int
+}
+
+// 频道参数的类型
+const (
+	CHANNEL_PATTERN int = 1 << 0 // 参数是频道的模式，例如PSUBSCRIBE
+)
+
+// channelSpec 和keySpec一样描述频道参数的位置，ACL根据它检查用户能否访问这些频道
+type channelSpec struct {
+	flags       int // CHANNEL_*
+	beginIndex  int
+	lastChannel int
+	step        int
+}
+
+// fullName 子命令的名字形如 slowlog|get
+func (cmd *GoRedisCommand) fullName() string {
+	if cmd.parent != nil {
+		return cmd.parent.name + "|" + cmd.name
+	}
+	return cmd.name
+}
+
+// checkArity 负数的arity表示至少需要-arity个参数
+func (cmd *GoRedisCommand) checkArity(argc int) bool {
+	if cmd.arity > 0 {
+		return cmd.arity == argc
+	}
+	return argc >= -cmd.arity
+}
+
+// allAclCategories 在声明的分类基础上加上由标志推导出的分类
+func (cmd *GoRedisCommand) allAclCategories() int {
+	cat := cmd.aclCategories
+	if cmd.flags&CMD_WRITE != 0 {
+		cat |= ACL_CATEGORY_WRITE
+	}
+	if cmd.flags&CMD_READONLY != 0 {
+		cat |= ACL_CATEGORY_READ
+	}
+	if cmd.flags&CMD_ADMIN != 0 {
+		cat |= ACL_CATEGORY_ADMIN | ACL_CATEGORY_DANGEROUS
+	}
+	if cmd.flags&CMD_PUBSUB != 0 {
+		cat |= ACL_CATEGORY_PUBSUB
+	}
+	if cmd.flags&CMD_BLOCKING != 0 {
+		cat |= ACL_CATEGORY_BLOCKING
+	}
+	if cmd.flags&CMD_FAST != 0 {
+		cat |= ACL_CATEGORY_FAST
+	} else {
+		cat |= ACL_CATEGORY_SLOW
+	}
+	return cat
+}
+
+// legacyRange 由key spec推导出老版本的 first key, last key, step
+func (cmd *GoRedisCommand) legacyRange() (first, last, step int) {
+	if len(cmd.keySpecs) == 0 {
+		return 0, 0, 0
+	}
+	ks := cmd.keySpecs[0]
+	first, step = ks.beginIndex, ks.keyStep
+	if ks.lastKey >= 0 {
+		last = ks.beginIndex + ks.lastKey
+	} else {
+		last = ks.lastKey
+	}
+	return
+}
+
+// specIndexes 按照起始下标、最后一个参数的偏移以及步长找出参数的下标，
+// last为负数时从参数的末尾开始算
+func specIndexes(idx []int, begin, last, step, argc int) []int {
+	if last < 0 {
+		last = argc + last
+	} else {
+		last += begin
+	}
+	for i := begin; i <= last && i < argc; i += step {
+		idx = append(idx, i)
+	}
+	return idx
+}
+
+// getKeys 根据key spec从参数中找出所有的key的下标
+func (cmd *GoRedisCommand) getKeys(argc int) []int {
+	keys := make([]int, 0)
+	for _, ks := range cmd.keySpecs {
+		keys = specIndexes(keys, ks.beginIndex, ks.lastKey, ks.keyStep, argc)
+	}
+	return keys
+}
+
+// lookupSubcommand 容器命令根据第二个参数找子命令
+func (cmd *GoRedisCommand) lookupSubcommand(name string) *GoRedisCommand {
+	return cmd.subcommandsDict[strings.ToLower(name)]
+}
+
+// populateCommandTable 把命令表放进字典，命令名不区分大小写
+func populateCommandTable() {
+	server.commands = make(map[string]*GoRedisCommand, len(cmdTable))
+	for i := range cmdTable {
+		// 存表中元素的指针，命令统计要写回表里
+		cmd := &cmdTable[i]
+		cmd.calls, cmd.microseconds = 0, 0
+		server.commands[cmd.name] = cmd
+		if len(cmd.subcommands) == 0 {
+			continue
+		}
+		cmd.subcommandsDict = make(map[string]*GoRedisCommand, len(cmd.subcommands))
+		for j := range cmd.subcommands {
+			sub := &cmd.subcommands[j]
+			sub.parent = cmd
+			sub.calls, sub.microseconds = 0, 0
+			cmd.subcommandsDict[sub.name] = sub
+		}
+	}
+}
+
+func lookupCommand(cmdStr string) *GoRedisCommand {
+	return server.commands[strings.ToLower(cmdStr)]
+}
+
+// lookupCommandByName 支持 slowlog|get 形式的子命令名
+func lookupCommandByName(name string) *GoRedisCommand {
+	parts := strings.SplitN(name, "|", 2)
+	cmd := lookupCommand(parts[0])
+	if cmd == nil || len(parts) == 1 {
+		return cmd
+	}
+	return cmd.lookupSubcommand(parts[1])
+}
+
+// sortedCommands 按名字排序返回所有顶层命令
+func sortedCommands() []*GoRedisCommand {
+	cmds := make([]*GoRedisCommand, 0, len(server.commands))
+	for _, cmd := range server.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].name < cmds[j].name
+	})
+	return cmds
+}
+
+func addReplyFlagNames(c *GoRedisClient, flags int, names []struct {
+	flag int
+	name string
+}, prefix string) {
+	n := 0
+	node := c.AddReplyDeferredLen()
+	for _, f := range names {
+		if flags&f.flag != 0 {
+			c.AddReplyStatus(prefix + f.name)
+			n++
+		}
+	}
+	c.SetDeferredSetLen(node, n)
+}
+
+func addReplyKeySpecs(c *GoRedisClient, cmd *GoRedisCommand) {
+	c.AddReplyArrayLen(len(cmd.keySpecs))
+	for _, ks := range cmd.keySpecs {
+		c.AddReplyMapLen(3)
+		c.AddReplyBulk("flags")
+		addReplyFlagNames(c, ks.flags, keySpecFlagNames, "")
+		c.AddReplyBulk("begin_search")
+		c.AddReplyMapLen(2)
+		c.AddReplyBulk("type")
+		c.AddReplyBulk("index")
+		c.AddReplyBulk("spec")
+		c.AddReplyMapLen(1)
+		c.AddReplyBulk("index")
+		c.AddReplyInt(int64(ks.beginIndex))
+		c.AddReplyBulk("find_keys")
+		c.AddReplyMapLen(2)
+		c.AddReplyBulk("type")
+		c.AddReplyBulk("range")
+		c.AddReplyBulk("spec")
+		c.AddReplyMapLen(3)
+		c.AddReplyBulk("lastkey")
+		c.AddReplyInt(int64(ks.lastKey))
+		c.AddReplyBulk("keystep")
+		c.AddReplyInt(int64(ks.keyStep))
+		c.AddReplyBulk("limit")
+		c.AddReplyInt(0)
+	}
+}
+
+// addReplyCommandInfo 按照redis7的COMMAND INFO格式回复一个命令
+func addReplyCommandInfo(c *GoRedisClient, cmd *GoRedisCommand) {
+	if cmd == nil {
+		c.AddReplyNull()
+		return
+	}
+	first, last, step := cmd.legacyRange()
+	c.AddReplyArrayLen(10)
+	c.AddReplyBulk(cmd.fullName())
+	c.AddReplyInt(int64(cmd.arity))
+	addReplyFlagNames(c, cmd.flags, cmdFlagNames, "")
+	c.AddReplyInt(int64(first))
+	c.AddReplyInt(int64(last))
+	c.AddReplyInt(int64(step))
+	addReplyFlagNames(c, cmd.allAclCategories(), aclCategoryNames, "@")
+	c.AddReplyArrayLen(len(cmd.tips))
+	for _, tip := range cmd.tips {
+		c.AddReplyBulk(tip)
+	}
+	addReplyKeySpecs(c, cmd)
+	c.AddReplyArrayLen(len(cmd.subcommands))
+	for i := range cmd.subcommands {
+		addReplyCommandInfo(c, &cmd.subcommands[i])
+	}
+}
+
+// addReplyCommandDocs 回复命令文档
+func addReplyCommandDocs(c *GoRedisClient, cmd *GoRedisCommand) {
+	fields := 4
+	if len(cmd.subcommands) > 0 {
+		fields++
+	}
+	c.AddReplyMapLen(fields)
+	c.AddReplyBulk("summary")
+	c.AddReplyBulk(cmd.summary)
+	c.AddReplyBulk("since")
+	c.AddReplyBulk(cmd.since)
+	c.AddReplyBulk("group")
+	c.AddReplyBulk(cmd.group)
+	c.AddReplyBulk("complexity")
+	c.AddReplyBulk(cmd.complexity)
+	if len(cmd.subcommands) > 0 {
+		c.AddReplyBulk("subcommands")
+		c.AddReplyMapLen(len(cmd.subcommands))
+		for i := range cmd.subcommands {
+			c.AddReplyBulk(cmd.subcommands[i].fullName())
+			addReplyCommandDocs(c, &cmd.subcommands[i])
+		}
+	}
+}
+
+func commandGetKeys(c *GoRedisClient) {
+	args := c.args[2:]
+	cmd := lookupCommand(args[0].StrVal())
+	if cmd != nil && len(cmd.subcommands) > 0 && len(args) >= 2 {
+		cmd = cmd.lookupSubcommand(args[1].StrVal())
+	}
+	if cmd == nil {
+		c.AddReplyError("Invalid command specified")
+		return
+	} else if !cmd.checkArity(len(args)) {
+		c.AddReplyError("Invalid number of arguments specified for command")
+		return
+	}
+	keys := cmd.getKeys(len(args))
+	if len(keys) == 0 {
+		c.AddReplyError("The command has no key arguments")
+		return
+	}
+	c.AddReplyArrayLen(len(keys))
+	for _, i := range keys {
+		c.AddReplyBulk(args[i].StrVal())
+	}
+}
+
+func commandCommand(c *GoRedisClient) {
+	if len(c.args) == 1 {
+		cmds := sortedCommands()
+		c.AddReplyArrayLen(len(cmds))
+		for _, cmd := range cmds {
+			addReplyCommandInfo(c, cmd)
+		}
+		return
+	}
+	switch strings.ToLower(c.args[1].StrVal()) {
+	case "count":
+		c.AddReplyInt(int64(len(server.commands)))
+	case "info":
+		if len(c.args) == 2 {
+			cmds := sortedCommands()
+			c.AddReplyArrayLen(len(cmds))
+			for _, cmd := range cmds {
+				addReplyCommandInfo(c, cmd)
+			}
+			return
+		}
+		c.AddReplyArrayLen(len(c.args) - 2)
+		for _, arg := range c.args[2:] {
+			addReplyCommandInfo(c, lookupCommandByName(arg.StrVal()))
+		}
+	case "docs":
+		var cmds []*GoRedisCommand
+		if len(c.args) == 2 {
+			cmds = sortedCommands()
+		} else {
+			for _, arg := range c.args[2:] {
+				// 找不到的命令直接忽略
+				if cmd := lookupCommandByName(arg.StrVal()); cmd != nil {
+					cmds = append(cmds, cmd)
+				}
+			}
+		}
+		c.AddReplyMapLen(len(cmds))
+		for _, cmd := range cmds {
+			c.AddReplyBulk(cmd.fullName())
+			addReplyCommandDocs(c, cmd)
+		}
+	case "getkeys":
+		commandGetKeys(c)
+	case "help":
+		help := []string{
+			"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"(no subcommand)",
+			"    Return details about all commands.",
+			"COUNT",
+			"    Return the total number of commands in this server.",
+			"INFO [<command-name> ...]",
+			"    Return details about multiple commands.",
+			"DOCS [<command-name> ...]",
+			"    Return documentation details about multiple commands.",
+			"GETKEYS <full-command>",
+			"    Return the keys from a full command.",
+		}
+		c.AddReplyHelp(help)
+	default:
+		c.AddReplyErrorFormat("unknown subcommand '%s'. Try COMMAND HELP.", c.args[1].StrVal())
+	}
+}
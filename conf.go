@@ -1,41 +1,511 @@
 package main
 
 import (
-	"io"
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	DEFAULT_PORT               int   = 6379
+	DEFAULT_SLOWLOG_SLOWER     int   = 10000 // us
+	DEFAULT_SLOWLOG_MAX_LEN    int   = 128
+	DEFAULT_ACLLOG_MAX_LEN     int   = 128
+	DEFAULT_PROTO_MAX_BULK_LEN int64 = 512 * 1024 * 1024
+	MIN_PROTO_MAX_BULK_LEN     int64 = 1024 * 1024
+	DEFAULT_QUERY_BUF_LIMIT    int64 = 1024 * 1024 * 1024
+	DEFAULT_MAX_CLIENTS        int   = 10000
+	DEFAULT_SHUTDOWN_TIMEOUT   int   = 10 // s
+	DEFAULT_IO_THREADS         int   = 1
+	MIN_QUERY_BUF_LIMIT        int64 = 1024 * 1024
+	CONFIG_MAX_INCLUDE_DEPTH   int   = 16 // include嵌套的最大深度，防止循环include
+	CONFIG_BINDADDR_MAX        int   = 16
+)
+
+// tls-auth-clients 的取值，零值和redis一样要求客户端提供证书
+const (
+	TLS_CLIENT_AUTH_YES int = iota
+	TLS_CLIENT_AUTH_NO
+	TLS_CLIENT_AUTH_OPTIONAL
+)
+
+// 没有配置bind时监听所有的IPv4地址，以及所有的IPv6地址(如果系统支持)
+var defaultBindAddrs = []string{"*", "-::*"}
+
 type Config struct {
-	Port int `yaml:"port"`
+	Port                 int
+	Bind                 []string // 监听的地址，"-" 开头表示地址不可用时跳过
+	Maxmemory            int64
+	SlowlogLogSlowerThan int // us，负数表示关闭slowlog，0表示记录所有命令
+	SlowlogMaxLen        int
+	Requirepass          string // default用户的密码
+	Aclfile              string // ACL SAVE/LOAD 使用的用户文件
+	AcllogMaxLen         int
+	Users                [][]string // 配置文件中的 user 指令，每一条是用户名加规则
+	ProtoMaxBulkLen      int64      // 单个bulk参数的最大长度，0表示使用默认值
+	ClientObufLimits     [CLIENT_TYPE_COUNT]clientBufferLimit
+	ClientQueryBufLimit  int64  // 单个客户端未处理的请求的最大长度，0表示使用默认值
+	Maxclients           int    // 最大连接数，0表示使用默认值
+	Timeout              int    // 秒，客户端空闲超过这个时间会被关闭，0表示不关闭
+	Unixsocket           string // unix socket的路径，为空时不监听
+	Unixsocketperm       uint32 // unix socket文件的权限，0表示不修改
+	ProtectedMode        bool   // 没有配置bind和密码时只接受本机的连接
+	TlsPort              int    // TLS连接的端口，0表示不监听
+	TlsCertFile          string
+	TlsKeyFile           string
+	TlsCaCertFile        string // 校验客户端证书的CA
+	TlsAuthClients       int    // 是否要求客户端提供证书，TLS_CLIENT_AUTH_*
+	Pidfile              string
+	ShutdownTimeout      int    // 秒，SHUTDOWN 等待回复发送完的最长时间，0表示不等待
+	Poller               string // IO多路复用的实现，epoll或者poll，为空时使用epoll
+	IoThreads            int    // 读写socket的线程数，包括主goroutine，1表示不使用IO线程
 }
 
-func LoadConfig(path string) (config *Config, err error) {
-	config = &Config{}
-	if path == "" {
-		p, err := strconv.Atoi(os.Getenv("PORT"))
+// clientBufferLimit 回复链表超过hard立即断开，超过soft持续softSeconds秒后断开，0表示不限制
+type clientBufferLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int64
+}
+
+// 和redis一样，普通客户端默认不限制，replica和pubsub客户端消费慢时会被断开
+var defaultClientObufLimits = [CLIENT_TYPE_COUNT]clientBufferLimit{
+	CLIENT_TYPE_NORMAL:  {0, 0, 0},
+	CLIENT_TYPE_REPLICA: {256 << 20, 64 << 20, 60},
+	CLIENT_TYPE_PUBSUB:  {32 << 20, 8 << 20, 60},
+}
+
+// NewConfig 返回带有默认值的配置
+func NewConfig() *Config {
+	return &Config{
+		Port:                 DEFAULT_PORT,
+		SlowlogLogSlowerThan: DEFAULT_SLOWLOG_SLOWER,
+		SlowlogMaxLen:        DEFAULT_SLOWLOG_MAX_LEN,
+		AcllogMaxLen:         DEFAULT_ACLLOG_MAX_LEN,
+		ProtoMaxBulkLen:      DEFAULT_PROTO_MAX_BULK_LEN,
+		ClientObufLimits:     defaultClientObufLimits,
+		ClientQueryBufLimit:  DEFAULT_QUERY_BUF_LIMIT,
+		Maxclients:           DEFAULT_MAX_CLIENTS,
+		ProtectedMode:        true,
+		ShutdownTimeout:      DEFAULT_SHUTDOWN_TIMEOUT,
+		IoThreads:            DEFAULT_IO_THREADS,
+	}
+}
+
+// protoMaxBulkLen 单个bulk参数的最大长度，没有配置时使用默认值
+func (config *Config) protoMaxBulkLen() int64 {
+	if config == nil || config.ProtoMaxBulkLen <= 0 {
+		return DEFAULT_PROTO_MAX_BULK_LEN
+	}
+	return config.ProtoMaxBulkLen
+}
+
+// clientQueryBufLimit 客户端请求缓冲区的上限，没有配置时使用默认值
+func (config *Config) clientQueryBufLimit() int64 {
+	if config == nil || config.ClientQueryBufLimit <= 0 {
+		return DEFAULT_QUERY_BUF_LIMIT
+	}
+	return config.ClientQueryBufLimit
+}
+
+// maxClients 最大连接数，没有配置时使用默认值
+func (config *Config) maxClients() int {
+	if config == nil || config.Maxclients <= 0 {
+		return DEFAULT_MAX_CLIENTS
+	}
+	return config.Maxclients
+}
+
+// ioThreads IO线程数，没有配置时使用默认值
+func (config *Config) ioThreads() int {
+	if config == nil || config.IoThreads <= 0 {
+		return DEFAULT_IO_THREADS
+	}
+	return config.IoThreads
+}
+
+// bindAddrs 需要监听的地址，没有配置时使用默认值
+func (config *Config) bindAddrs() []string {
+	if config == nil || len(config.Bind) == 0 {
+		return defaultBindAddrs
+	}
+	return config.Bind
+}
+
+// parseBindArg 检查bind的每个地址，地址前面可以加 "-"
+func parseBindArg(args []string) ([]string, error) {
+	if len(args) == 0 || len(args) > CONFIG_BINDADDR_MAX {
+		return nil, fmt.Errorf("too many bind addresses specified")
+	}
+	for _, addr := range args {
+		host := strings.TrimPrefix(addr, "-")
+		if host != "*" && host != "::*" && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid bind address '%v'", addr)
+		}
+	}
+	return args, nil
+}
+
+// parseObufLimitArg 解析 <class> <hard> <soft> <soft seconds>，可以一次设置多个类别
+func (config *Config) parseObufLimitArg(args []string) error {
+	if len(args) == 0 || len(args)%4 != 0 {
+		return errors.New("wrong number of arguments")
+	}
+	// 先全部解析成功再修改，避免只生效一部分
+	limits := config.ClientObufLimits
+	for i := 0; i < len(args); i += 4 {
+		class := getClientTypeByName(args[i])
+		if class < 0 || class == CLIENT_TYPE_MASTER {
+			return fmt.Errorf("invalid client class '%s'", args[i])
+		}
+		hard, err := memToInt(args[i+1])
+		if err != nil {
+			return err
+		}
+		soft, err := memToInt(args[i+2])
 		if err != nil {
-			return nil, err
+			return err
+		}
+		seconds, err := strconv.ParseInt(args[i+3], 10, 64)
+		if err != nil || hard < 0 || soft < 0 || seconds < 0 {
+			return errors.New("limits must be non-negative")
+		}
+		limits[class] = clientBufferLimit{hard, soft, seconds}
+	}
+	config.ClientObufLimits = limits
+	return nil
+}
+
+func parseIntArg(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errors.New("wrong number of arguments")
+	}
+	return strconv.Atoi(args[0])
+}
+
+func parseStringArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("wrong number of arguments")
+	}
+	return args[0], nil
+}
+
+func parseMemArg(args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, errors.New("wrong number of arguments")
+	}
+	return memToInt(args[0])
+}
+
+func parseYesNoArg(args []string) (bool, error) {
+	if len(args) != 1 {
+		return false, errors.New("wrong number of arguments")
+	}
+	switch strings.ToLower(args[0]) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+func parseTlsAuthClientsArg(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, errors.New("wrong number of arguments")
+	}
+	switch strings.ToLower(args[0]) {
+	case "yes":
+		return TLS_CLIENT_AUTH_YES, nil
+	case "no":
+		return TLS_CLIENT_AUTH_NO, nil
+	case "optional":
+		return TLS_CLIENT_AUTH_OPTIONAL, nil
+	}
+	return 0, errors.New("argument must be 'yes', 'no' or 'optional'")
+}
+
+// parsePermArg 解析八进制的文件权限，例如 700
+func parsePermArg(args []string) (uint32, error) {
+	if len(args) != 1 {
+		return 0, errors.New("wrong number of arguments")
+	}
+	perm, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, errors.New("invalid socket file permissions")
+	}
+	return uint32(perm), nil
+}
+
+func parsePollerArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("wrong number of arguments")
+	}
+	switch name := strings.ToLower(args[0]); name {
+	case "epoll", "poll":
+		return name, nil
+	}
+	return "", errors.New("argument must be 'epoll' or 'poll'")
+}
+
+// applyDirective 设置一条配置项，yaml、redis.conf以及命令行参数最终都走这里
+func (config *Config) applyDirective(name string, args []string) (err error) {
+	switch strings.ToLower(name) {
+	case "port":
+		config.Port, err = parseIntArg(args)
+	case "bind":
+		config.Bind, err = parseBindArg(args)
+	case "maxmemory":
+		config.Maxmemory, err = parseMemArg(args)
+	case "slowlog-log-slower-than":
+		config.SlowlogLogSlowerThan, err = parseIntArg(args)
+	case "slowlog-max-len":
+		config.SlowlogMaxLen, err = parseIntArg(args)
+		if err == nil && config.SlowlogMaxLen < 0 {
+			err = errors.New("must be non-negative")
+		}
+	case "requirepass":
+		config.Requirepass, err = parseStringArg(args)
+	case "aclfile":
+		config.Aclfile, err = parseStringArg(args)
+	case "acllog-max-len":
+		config.AcllogMaxLen, err = parseIntArg(args)
+		if err == nil && config.AcllogMaxLen < 0 {
+			err = errors.New("must be non-negative")
+		}
+	case "proto-max-bulk-len":
+		config.ProtoMaxBulkLen, err = parseMemArg(args)
+		if err == nil && config.ProtoMaxBulkLen < MIN_PROTO_MAX_BULK_LEN {
+			err = fmt.Errorf("must be at least %d", MIN_PROTO_MAX_BULK_LEN)
+		}
+	case "client-output-buffer-limit":
+		err = config.parseObufLimitArg(args)
+	case "client-query-buffer-limit":
+		config.ClientQueryBufLimit, err = parseMemArg(args)
+		if err == nil && config.ClientQueryBufLimit < MIN_QUERY_BUF_LIMIT {
+			err = fmt.Errorf("must be at least %d", MIN_QUERY_BUF_LIMIT)
+		}
+	case "maxclients":
+		config.Maxclients, err = parseIntArg(args)
+		if err == nil && config.Maxclients < 1 {
+			err = errors.New("must be at least 1")
+		}
+	case "timeout":
+		config.Timeout, err = parseIntArg(args)
+		if err == nil && config.Timeout < 0 {
+			err = errors.New("must be non-negative")
+		}
+	case "unixsocket":
+		config.Unixsocket, err = parseStringArg(args)
+	case "unixsocketperm":
+		config.Unixsocketperm, err = parsePermArg(args)
+	case "protected-mode":
+		config.ProtectedMode, err = parseYesNoArg(args)
+	case "tls-port":
+		config.TlsPort, err = parseIntArg(args)
+		if err == nil && (config.TlsPort < 0 || config.TlsPort > 65535) {
+			err = errors.New("port out of range")
+		}
+	case "tls-cert-file":
+		config.TlsCertFile, err = parseStringArg(args)
+	case "tls-key-file":
+		config.TlsKeyFile, err = parseStringArg(args)
+	case "tls-ca-cert-file":
+		config.TlsCaCertFile, err = parseStringArg(args)
+	case "tls-auth-clients":
+		config.TlsAuthClients, err = parseTlsAuthClientsArg(args)
+	case "pidfile":
+		config.Pidfile, err = parseStringArg(args)
+	case "shutdown-timeout":
+		config.ShutdownTimeout, err = parseIntArg(args)
+		if err == nil && config.ShutdownTimeout < 0 {
+			err = errors.New("must be non-negative")
+		}
+	case "io-threads":
+		config.IoThreads, err = parseIntArg(args)
+		if err == nil && (config.IoThreads < 1 || config.IoThreads > IO_THREADS_MAX_NUM) {
+			err = fmt.Errorf("must be between 1 and %d", IO_THREADS_MAX_NUM)
 		}
-		config.Port = p
-		return config, nil
+	case "poller":
+		config.Poller, err = parsePollerArg(args)
+	case "user":
+		if len(args) == 0 {
+			err = errors.New("wrong number of arguments")
+		} else {
+			config.Users = append(config.Users, args)
+		}
+	default:
+		return fmt.Errorf("bad directive or wrong number of arguments: %v", name)
 	}
-	file, err := os.Open(path)
 	if err != nil {
-		return
+		return fmt.Errorf("invalid argument for '%v': %v", name, err)
+	}
+	return nil
+}
+
+// isYamlConfig 判断配置文件是否为yaml格式，redis.conf的指令后面不会跟冒号
+func isYamlConfig(path string, data []byte) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		return true
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		return strings.HasSuffix(strings.Fields(line)[0], ":")
+	}
+	return false
+}
+
+// yamlValueToArgs 把yaml的值转换为指令参数，列表的每个元素都是一个参数
+func yamlValueToArgs(val interface{}) []string {
+	switch v := val.(type) {
+	case nil:
+		return []string{""}
+	case bool:
+		if v {
+			return []string{"yes"}
+		}
+		return []string{"no"}
+	case []interface{}:
+		args := make([]string, 0, len(v))
+		for _, e := range v {
+			args = append(args, yamlValueToArgs(e)...)
+		}
+		return args
+	default:
+		// 形如 "save 900 1" 的值也允许写在一个字符串里
+		args, err := splitArgs(fmt.Sprint(v))
+		if err != nil || len(args) == 0 {
+			return []string{fmt.Sprint(v)}
+		}
+		return args
+	}
+}
+
+func (config *Config) loadYaml(data []byte) error {
+	var items yaml.MapSlice
+	if err := yaml.Unmarshal(data, &items); err != nil {
+		return err
 	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-	jsonStr, err := io.ReadAll(file)
+	for _, item := range items {
+		if err := config.applyDirective(fmt.Sprint(item.Key), yamlValueToArgs(item.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRedisConf 解析redis.conf格式，每行一条指令，支持引号参数和include
+func (config *Config) loadRedisConf(path string, data []byte, depth int) error {
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", path, lineNum, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if strings.EqualFold(args[0], "include") {
+			if len(args) != 2 {
+				return fmt.Errorf("%v:%v: include expects one file", path, lineNum)
+			}
+			if err = config.loadFile(args[1], depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = config.applyDirective(args[0], args[1:]); err != nil {
+			return fmt.Errorf("%v:%v: %v", path, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (config *Config) loadFile(path string, depth int) error {
+	if depth > CONFIG_MAX_INCLUDE_DEPTH {
+		return fmt.Errorf("too many nested includes: %v", path)
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return
+		return err
+	}
+	if isYamlConfig(path, data) {
+		return config.loadYaml(data)
 	}
+	return config.loadRedisConf(path, data, depth)
+}
+
+// parseOverrides 解析形如 --port 7000 --maxmemory 1gb 的命令行参数，
+// 每个--name后面直到下一个--name之前的都是它的参数
+func (config *Config) parseOverrides(overrides []string) error {
+	var name string
+	var args []string
+	flush := func() error {
+		if name == "" {
+			return nil
+		}
+		return config.applyDirective(name, args)
+	}
+	for _, v := range overrides {
+		if strings.HasPrefix(v, "--") && len(v) > 2 {
+			if err := flush(); err != nil {
+				return err
+			}
+			name = v[2:]
+			args = nil
+			continue
+		}
+		if name == "" {
+			return fmt.Errorf("unexpected argument: %v", v)
+		}
+		args = append(args, v)
+	}
+	return flush()
+}
 
-	if err = yaml.Unmarshal(jsonStr, config); err != nil {
+// ParseArgs 把启动参数拆分为配置文件路径和覆盖项
+func ParseArgs(argv []string) (path string, overrides []string) {
+	if len(argv) > 0 && !strings.HasPrefix(argv[0], "--") {
+		return argv[0], argv[1:]
+	}
+	return "", argv
+}
+
+// LoadConfig 加载配置文件，自动识别yaml和redis.conf格式，命令行的覆盖项优先级最高
+func LoadConfig(path string, overrides []string) (*Config, error) {
+	config := NewConfig()
+	if path == "" {
+		// 没有配置文件时从环境变量读端口
+		if env := os.Getenv("PORT"); env != "" {
+			p, err := strconv.Atoi(env)
+			if err != nil {
+				return nil, err
+			}
+			config.Port = p
+		}
+	} else if err := config.loadFile(path, 0); err != nil {
+		return nil, err
+	}
+	if err := config.parseOverrides(overrides); err != nil {
 		return nil, err
 	}
-	return
+	return config, nil
 }
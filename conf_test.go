@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`set  k "hello\x20world\n" 'it\'s'`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"set", "k", "hello world\n", "it's"}, args)
+
+	args, err = splitArgs(`   `)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(args))
+
+	_, err = splitArgs(`set k "val`)
+	assert.Equal(t, ErrUnbalancedQuotes, err)
+	_, err = splitArgs(`set k "val"x`)
+	assert.Equal(t, ErrUnbalancedQuotes, err)
+}
+
+func TestMemToInt(t *testing.T) {
+	for s, v := range map[string]int64{"100": 100, "1k": 1000, "1kb": 1024, "2MB": 2 << 20, "1gb": 1 << 30} {
+		n, err := memToInt(s)
+		assert.Nil(t, err)
+		assert.Equal(t, v, n)
+	}
+	for _, s := range []string{"1tb", "-1", "-1gb", "9223372036854775807k", "8589934592gb"} {
+		_, err := memToInt(s)
+		assert.NotNil(t, err, s)
+	}
+	n, err := memToInt("8589934591gb")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8589934591)<<30, n)
+	// 负数和溢出的值不会进入配置
+	config := NewConfig()
+	assert.NotNil(t, config.applyDirective("maxmemory", []string{"-1gb"}))
+	assert.NotNil(t, config.applyDirective("proto-max-bulk-len", []string{"9223372036854775807kb"}))
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "config.yaml")
+	assert.Nil(t, os.WriteFile(yamlPath, []byte("port: 6767\nmaxmemory: 1mb\n"), 0644))
+	config, err := LoadConfig(yamlPath, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 6767, config.Port)
+	assert.Equal(t, int64(1<<20), config.Maxmemory)
+
+	incPath := filepath.Join(dir, "inc.conf")
+	assert.Nil(t, os.WriteFile(incPath, []byte("maxmemory 2gb\n"), 0644))
+	confPath := filepath.Join(dir, "redis.conf")
+	assert.Nil(t, os.WriteFile(confPath, []byte("# comment\nport 7000\ninclude \""+incPath+"\"\n"), 0644))
+	config, err = LoadConfig(confPath, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 7000, config.Port)
+	assert.Equal(t, int64(2<<30), config.Maxmemory)
+
+	// 命令行覆盖文件中的配置
+	path, overrides := ParseArgs([]string{confPath, "--port", "7001", "--maxmemory", "1kb"})
+	config, err = LoadConfig(path, overrides)
+	assert.Nil(t, err)
+	assert.Equal(t, 7001, config.Port)
+	assert.Equal(t, int64(1024), config.Maxmemory)
+
+	_, err = LoadConfig("", []string{"--no-such-option", "1"})
+	assert.NotNil(t, err)
+}
+
+func TestStringMatch(t *testing.T) {
+	assert.True(t, stringMatch("*", "", false))
+	assert.True(t, stringMatch("user:*", "user:1", false))
+	assert.False(t, stringMatch("user:*", "admin:1", false))
+	assert.True(t, stringMatch("h?llo", "hello", false))
+	assert.True(t, stringMatch("h[ae]llo", "hallo", false))
+	assert.False(t, stringMatch("h[^e]llo", "hello", false))
+	assert.True(t, stringMatch("h[a-c]llo", "hbllo", false))
+	assert.True(t, stringMatch("HELLO", "hello", true))
+	assert.True(t, stringMatch(`a\*b`, "a*b", false))
+	assert.False(t, stringMatch(`a\*b`, "axb", false))
+	assert.True(t, stringMatch("a*b*c", "aXXbYYc", false))
+}
+
+func TestClientBufferLimitConfig(t *testing.T) {
+	config := NewConfig()
+	assert.Equal(t, defaultClientObufLimits, config.ClientObufLimits)
+	assert.Nil(t, config.applyDirective("client-output-buffer-limit",
+		[]string{"normal", "1mb", "512kb", "10", "slave", "0", "0", "0"}))
+	assert.Equal(t, clientBufferLimit{1 << 20, 512 << 10, 10}, config.ClientObufLimits[CLIENT_TYPE_NORMAL])
+	assert.Equal(t, clientBufferLimit{}, config.ClientObufLimits[CLIENT_TYPE_REPLICA])
+	// 任何一组出错都不修改
+	assert.NotNil(t, config.applyDirective("client-output-buffer-limit",
+		[]string{"pubsub", "1mb", "1mb", "1", "nosuch", "0", "0", "0"}))
+	assert.Equal(t, defaultClientObufLimits[CLIENT_TYPE_PUBSUB], config.ClientObufLimits[CLIENT_TYPE_PUBSUB])
+
+	assert.Nil(t, config.applyDirective("client-query-buffer-limit", []string{"2mb"}))
+	assert.Equal(t, int64(2<<20), config.ClientQueryBufLimit)
+	assert.NotNil(t, config.applyDirective("client-query-buffer-limit", []string{"1kb"}))
+}
+
+func TestUnixSocketConfig(t *testing.T) {
+	config := NewConfig()
+	assert.Nil(t, config.applyDirective("unixsocket", []string{"/tmp/redis.sock"}))
+	assert.Nil(t, config.applyDirective("unixsocketperm", []string{"770"}))
+	assert.Equal(t, "/tmp/redis.sock", config.Unixsocket)
+	assert.Equal(t, uint32(0770), config.Unixsocketperm)
+	assert.NotNil(t, config.applyDirective("unixsocketperm", []string{"778"}))
+	assert.NotNil(t, config.applyDirective("unixsocketperm", []string{"1777"}))
+}
+
+func TestBindConfig(t *testing.T) {
+	config := NewConfig()
+	assert.Equal(t, defaultBindAddrs, config.bindAddrs())
+	assert.Nil(t, config.applyDirective("bind", []string{"127.0.0.1", "-::1", "::*"}))
+	assert.Equal(t, []string{"127.0.0.1", "-::1", "::*"}, config.bindAddrs())
+	assert.NotNil(t, config.applyDirective("bind", []string{"localhost"}))
+	assert.NotNil(t, config.applyDirective("bind", nil))
+}
+
+func TestProtectedModeConfig(t *testing.T) {
+	config := NewConfig()
+	assert.True(t, config.ProtectedMode)
+	assert.Nil(t, config.applyDirective("protected-mode", []string{"no"}))
+	assert.False(t, config.ProtectedMode)
+	assert.NotNil(t, config.applyDirective("protected-mode", []string{"maybe"}))
+}
+
+func TestPollerConfig(t *testing.T) {
+	config := NewConfig()
+	assert.NotNil(t, config.applyDirective("poller", []string{"kqueue"}))
+	assert.Nil(t, config.applyDirective("poller", []string{"POLL"}))
+	assert.Equal(t, "poll", config.Poller)
+	assert.Nil(t, initServer(config))
+	defer closeListeningSockets()
+	assert.Equal(t, "poll", server.aeLoop.poller.Name())
+}
@@ -254,6 +254,7 @@ func (d *Dict) Delete(key *GObj) error {
 				} else {
 					prev.next = e.next
 				}
+				d.hts[i].used--
 				freeEntry(e)
 				return nil
 			}
@@ -293,6 +294,17 @@ func (d *Dict) Find(key *GObj) *Entry {
 	return nil
 }
 
+// Len 返回键值对的数量，rehash过程中两个桶都要算上
+func (d *Dict) Len() int64 {
+	var n int64
+	for i := 0; i <= 1; i++ {
+		if d.hts[i] != nil {
+			n += d.hts[i].used
+		}
+	}
+	return n
+}
+
 // Get 获取key对应的val
 func (d *Dict) Get(key *GObj) *GObj {
 	entry := d.Find(key)
@@ -0,0 +1,79 @@
+package main
+
+import "time"
+
+// activeExpireCycle 的两种模式，和redis的expire.c一致
+const (
+	ACTIVE_EXPIRE_CYCLE_SLOW int = iota // ServerCron中执行，时间预算是CRON_INTERVAL的一部分
+	ACTIVE_EXPIRE_CYCLE_FAST            // beforeSleep中执行，时间预算很短
+)
+
+const (
+	ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP    int           = 20               // 每轮随机检查的key数量
+	ACTIVE_EXPIRE_CYCLE_FAST_DURATION    time.Duration = time.Millisecond // 快速模式的时间预算
+	ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC   int64         = 25               // 慢速模式最多占用CRON_INTERVAL的百分比
+	ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE int           = 10               // 一轮中过期的比例不超过这个百分比时停止
+)
+
+// activeExpireCycle 每轮随机检查一批设置了过期时间的key，删除已经过期的，
+// 过期的比例较高时继续下一轮，直到比例降下来或者用完时间预算。
+// 快速模式只在上一次清理超时退出或者过期比例偏高时执行，并且两次之间至少间隔两倍的预算
+func activeExpireCycle(typ int) {
+	// CLIENT PAUSE 期间不主动删除过期的key
+	if server.clientPauseType != CLIENT_PAUSE_OFF {
+		return
+	}
+	start := time.Now()
+	timelimit := time.Duration(CRON_INTERVAL*ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC/100) * time.Millisecond
+	if typ == ACTIVE_EXPIRE_CYCLE_FAST {
+		if !server.expireTimelimitExit && server.stat.expiredStalePerc < float64(ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE) {
+			return
+		}
+		if start.Sub(server.expireLastFastCycle) < 2*ACTIVE_EXPIRE_CYCLE_FAST_DURATION {
+			return
+		}
+		server.expireLastFastCycle = start
+		timelimit = ACTIVE_EXPIRE_CYCLE_FAST_DURATION
+	}
+	server.expireTimelimitExit = false
+	// expire dict 的 val 是毫秒时间戳
+	now := GetMsTime()
+	sampled, expired := 0, 0
+	for iteration := 1; ; iteration++ {
+		num := ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP
+		if size := int(server.db.expire.Len()); size < num {
+			num = size
+		}
+		if num == 0 {
+			break
+		}
+		loopExpired := 0
+		for i := 0; i < num; i++ {
+			entry := server.db.expire.RandomGet()
+			if entry == nil {
+				break
+			}
+			sampled++
+			if entry.Val.IntVal() < now {
+				deleteExpiredKey(entry.Key)
+				loopExpired++
+			}
+		}
+		expired += loopExpired
+		// 每16轮检查一次是否超时，取时间也有开销
+		if iteration&0xf == 0 && time.Since(start) > timelimit {
+			server.expireTimelimitExit = true
+			server.stat.expiredTimeCapReachedCount++
+			break
+		}
+		if loopExpired*100 <= num*ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE {
+			break
+		}
+	}
+	// 过期比例取滑动平均，避免一次采样的偶然结果频繁触发快速模式
+	current := 0.0
+	if sampled > 0 {
+		current = float64(expired) * 100 / float64(sampled)
+	}
+	server.stat.expiredStalePerc = current*0.05 + server.stat.expiredStalePerc*0.95
+}
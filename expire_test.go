@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// addKeyWithExpire 直接写入字典，when是毫秒时间戳
+func addKeyWithExpire(key string, when int64) {
+	k := CreateObject(GSTR, key)
+	server.db.data.Set(k, CreateObject(GSTR, "v"))
+	server.db.expire.Set(k, CreateFromInt(when))
+}
+
+func TestActiveExpireCycle(t *testing.T) {
+	var conf Config
+	assert.Nil(t, initServer(&conf))
+	defer closeListeningSockets()
+	now := GetMsTime()
+	for i := 0; i < 1000; i++ {
+		addKeyWithExpire(fmt.Sprintf("expired:%d", i), now-1000)
+	}
+	for i := 0; i < 100; i++ {
+		addKeyWithExpire(fmt.Sprintf("live:%d", i), now+100000)
+	}
+
+	// CLIENT PAUSE 期间不删除
+	server.clientPauseType = CLIENT_PAUSE_WRITE
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_SLOW)
+	assert.Equal(t, int64(1100), server.db.expire.Len())
+	server.clientPauseType = CLIENT_PAUSE_OFF
+
+	// 过期比例高时一直清理到比例降下来
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_SLOW)
+	assert.True(t, server.stat.expiredKeys > 500)
+	assert.Equal(t, server.db.expire.Len(), server.db.data.Len())
+	assert.True(t, server.stat.expiredStalePerc > 0)
+	assert.Contains(t, genInfoString([]string{"stats"}), "expired_stale_perc:")
+
+	// 上一次没有超时、过期比例也不高时快速模式不执行
+	server.stat.expiredStalePerc = 0
+	server.expireTimelimitExit = false
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_FAST)
+	assert.True(t, server.expireLastFastCycle.IsZero())
+
+	// 上一次超时退出时在beforeSleep中快速清理，两次之间至少间隔两倍的时间预算
+	for i := 0; i < 1000; i++ {
+		addKeyWithExpire(fmt.Sprintf("expired:%d", i), now-1000)
+	}
+	expired := server.stat.expiredKeys
+	server.expireTimelimitExit = true
+	beforeSleep(server.aeLoop)
+	last := server.expireLastFastCycle
+	assert.False(t, last.IsZero())
+	assert.True(t, server.stat.expiredKeys > expired)
+	server.expireTimelimitExit = true
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_FAST)
+	assert.Equal(t, last, server.expireLastFastCycle)
+}
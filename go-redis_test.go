@@ -1,9 +1,14 @@
 package main
 
 import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 func ReadQuery(client *GoRedisClient, query string) {
@@ -66,13 +71,21 @@ func TestBulkBuf(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, true, ok)
 	assert.Equal(t, 3, len(client.args))
+
+	// 很短的头部声明了大量参数时，只预分配有限的空间
+	ReadQuery(client, "*1048576\r\n$3\r\nset\r\n")
+	ok, err = handleBulkBuf(client)
+	assert.Nil(t, err)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 1, len(client.args))
+	assert.Equal(t, MAX_ARGS_PREALLOC, cap(client.args))
 }
 
 func TestProcessQueryBuf(t *testing.T) {
 	var conf Config
 	initServer(&conf)
 	// just need real fd to support AddReply
-	client := CreateClient(server.fd)
+	client := CreateClient(server.ipfd[0])
 	ReadQuery(client, "*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$3\r\nval\r\n")
 	err := ProcessQueryBuf(client)
 	assert.Nil(t, err)
@@ -88,3 +101,398 @@ func TestProcessQueryBuf(t *testing.T) {
 	val2 := server.db.data.Get(key)
 	assert.Equal(t, "val2", val2.StrVal())
 }
+
+func TestInfo(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	client := CreateClient(server.ipfd[0])
+	// EXPIRE是写命令，不计入keyspace_hits/misses
+	ReadQuery(client, "set key val\r\nget key\r\nget nokey\r\nexpire key 100\r\nexpire nokey 100\r\n")
+	err := ProcessQueryBuf(client)
+	assert.Nil(t, err)
+
+	info := genInfoString([]string{"stats", "keyspace"})
+	assert.Contains(t, info, "# Stats\r\n")
+	assert.Contains(t, info, "total_commands_processed:5\r\n")
+	assert.Contains(t, info, "keyspace_hits:1\r\n")
+	assert.Contains(t, info, "keyspace_misses:1\r\n")
+	assert.Contains(t, info, "db0:keys=1,expires=1")
+	assert.NotContains(t, info, "# Server")
+
+	info = genInfoString(nil)
+	assert.Contains(t, info, "# Server\r\n")
+	assert.NotContains(t, info, "# Commandstats")
+	info = genInfoString([]string{"everything"})
+	assert.Contains(t, info, "cmdstat_set:calls=1,")
+}
+
+func TestSlowlog(t *testing.T) {
+	conf := Config{SlowlogLogSlowerThan: 0, SlowlogMaxLen: 2}
+	initServer(&conf)
+	client := CreateClient(server.ipfd[0])
+	ReadQuery(client, "set k1 v1\r\nset k2 v2\r\nget k1\r\n")
+	err := ProcessQueryBuf(client)
+	assert.Nil(t, err)
+
+	// 只保留最新的两条
+	entries := slowlogGet(-1)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, int64(2), entries[0].id)
+	assert.Equal(t, []string{"get", "k1"}, entries[0].args)
+	assert.Equal(t, []string{"set", "k2", "v2"}, entries[1].args)
+	assert.Equal(t, 1, len(slowlogGet(1)))
+
+	slowlogReset()
+	assert.Equal(t, 0, len(slowlogGet(-1)))
+
+	conf.SlowlogLogSlowerThan = -1
+	ReadQuery(client, "get k1\r\n")
+	err = ProcessQueryBuf(client)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(slowlogGet(-1)))
+}
+
+func TestMonitor(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	monitor := CreateClient(server.ipfd[0])
+	ReadQuery(monitor, "monitor\r\n")
+	assert.Nil(t, ProcessQueryBuf(monitor))
+	assert.Equal(t, 1, len(server.monitors))
+	assert.Equal(t, "+OK\r\n", takeReply(monitor))
+
+	client := CreateClient(server.ipfd[0])
+	ReadQuery(client, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$4\r\na\"b\n\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	msg := takeReply(monitor)
+	assert.Regexp(t, `^\+\d+\.\d{6} \[0 .*\] "set" "k" "a\\"b\\n"\r\n$`, msg)
+
+	// 管理类命令不推送
+	ReadQuery(client, "slowlog len\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	assert.Equal(t, "", takeReply(monitor))
+}
+
+func TestCommandTable(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	get := lookupCommand("GET")
+	assert.NotNil(t, get)
+	assert.True(t, get.checkArity(2))
+	assert.False(t, get.checkArity(3))
+	assert.Equal(t, []int{1}, get.getKeys(2))
+	first, last, step := get.legacyRange()
+	assert.Equal(t, []int{1, 1, 1}, []int{first, last, step})
+	assert.NotZero(t, get.allAclCategories()&ACL_CATEGORY_READ)
+
+	sub := lookupCommandByName("slowlog|GET")
+	assert.NotNil(t, sub)
+	assert.Equal(t, "slowlog|get", sub.fullName())
+	assert.True(t, sub.checkArity(3))
+	assert.False(t, sub.checkArity(1))
+	assert.Nil(t, lookupCommandByName("slowlog|nope"))
+
+	client := CreateClient(server.ipfd[0])
+	ReadQuery(client, "command getkeys set k v\r\n")
+	assert.Nil(t, ProcessQueryBuf(client))
+	assert.Equal(t, "*1\r\n$1\r\nk\r\n", takeReply(client))
+}
+
+func TestBigBulk(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	client := CreateClient(0)
+	ReadQuery(client, "*2\r\n$3\r\nget\r\n$0\r\n\r\n")
+	ok, err := handleBulkBuf(client)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "", client.args[1].StrVal())
+
+	// 大参数按照声明的长度预先分配缓冲区
+	ReadQuery(client, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$100000\r\n")
+	ok, err = handleBulkBuf(client)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 100002, len(client.queryBuf))
+	ReadQuery(client, strings.Repeat("x", 100000)+"\r\n")
+	ok, err = handleBulkBuf(client)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 100000, len(client.args[2].StrVal()))
+	assert.Equal(t, 0, client.queryLen)
+
+	conf.ProtoMaxBulkLen = MIN_PROTO_MAX_BULK_LEN
+	client = CreateClient(0)
+	ReadQuery(client, "*2\r\n$3\r\nget\r\n$2000000\r\n")
+	_, err = handleBulkBuf(client)
+	assert.NotNil(t, err)
+}
+
+func TestInlineQuoting(t *testing.T) {
+	client := CreateClient(0)
+	ReadQuery(client, "set  k \"hello\\x20world\\n\" 'a b'\n")
+	ok, err := handleInlineBuf(client)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 4, len(client.args))
+	assert.Equal(t, "hello world\n", client.args[2].StrVal())
+	assert.Equal(t, "a b", client.args[3].StrVal())
+
+	ReadQuery(client, "set k \"oops\r\n")
+	_, err = handleInlineBuf(client)
+	assert.Equal(t, "unbalanced quotes in request", err.Error())
+	assert.Equal(t, 0, client.queryLen)
+
+	var conf Config
+	initServer(&conf)
+	client = CreateClient(server.ipfd[0])
+	ReadQuery(client, "get 'k\r\nget k\r\n")
+	setProtocolError(client, ProcessQueryBuf(client))
+	assert.Equal(t, "-ERR Protocol error: unbalanced quotes in request\r\n", takeReply(client))
+	assert.NotZero(t, client.flags&CLIENT_CLOSE_AFTER_REPLY)
+}
+
+func TestQueryBufCompaction(t *testing.T) {
+	client := CreateClient(0)
+	ReadQuery(client, "*1\r\n$4\r\nping\r\n*2\r\n$3\r\nget")
+	ok, err := handleBulkBuf(client)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	resetClient(client)
+	ok, err = handleBulkBuf(client)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "get", string(client.pendingQuery()))
+
+	// 空间足够时只把未解析的数据挪到开头，不重新分配
+	first := &client.queryBuf[0]
+	client.makeRoomForQuery(IO_BUF - 3)
+	assert.Equal(t, 0, client.qbPos)
+	assert.Equal(t, first, &client.queryBuf[0])
+	ReadQuery(client, "\r\n$1\r\nk\r\n")
+	ok, err = handleBulkBuf(client)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "get", client.args[0].StrVal())
+	assert.Equal(t, 0, client.queryLen)
+
+	ReadQuery(client, "*1\r\n$x\r\n")
+	_, err = handleBulkBuf(client)
+	assert.Equal(t, "invalid bulk length", err.Error())
+}
+
+func benchmarkPipeline(b *testing.B, cmd string, handle func(*GoRedisClient) (bool, error)) {
+	client := CreateClient(0)
+	pipeline := []byte(strings.Repeat(cmd, IO_BUF/len(cmd)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	// 每次迭代解析一条命令，缓冲区解析完之后重新填满
+	for i := 0; i < b.N; i++ {
+		if client.queryLen == 0 {
+			client.queryLen = copy(client.queryBuf, pipeline)
+		}
+		if ok, err := handle(client); !ok || err != nil {
+			b.Fatal(ok, err)
+		}
+		resetClient(client)
+	}
+}
+
+func BenchmarkPipelinedBulk(b *testing.B) {
+	benchmarkPipeline(b, "*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", handleBulkBuf)
+}
+
+func BenchmarkPipelinedInline(b *testing.B) {
+	benchmarkPipeline(b, "set key value\r\n", handleInlineBuf)
+}
+
+func TestMaxclientsAndTimeout(t *testing.T) {
+	// initServer不修改进程的RLIMIT_NOFILE，只有main中才调整
+	var before, after unix.Rlimit
+	assert.Nil(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &before))
+	assert.Nil(t, initServer(&Config{Maxclients: 1 << 20}))
+	closeListeningSockets()
+	assert.Nil(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &after))
+	assert.Equal(t, before, after)
+
+	conf := Config{Maxclients: 1, Timeout: 10}
+	assert.Nil(t, initServer(&conf))
+	assert.Equal(t, 1, server.maxclients)
+	sa, err := unix.Getsockname(server.ipfd[0])
+	assert.Nil(t, err)
+	port := sa.(*unix.SockaddrInet4).Port
+
+	// 第一个连接正常接受，第二个收到错误后被关闭
+	first, err := Connect("127.0.0.1", port)
+	assert.Nil(t, err)
+	defer Close(first)
+	AcceptHandler(server.aeLoop, server.ipfd[0], nil)
+	assert.Equal(t, 1, len(server.clientList))
+	second, err := Connect("127.0.0.1", port)
+	assert.Nil(t, err)
+	defer Close(second)
+	AcceptHandler(server.aeLoop, server.ipfd[0], nil)
+	buf := make([]byte, 64)
+	n, err := Read(second, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR max number of clients reached\r\n", string(buf[:n]))
+	assert.Contains(t, genInfoString([]string{"stats"}), "rejected_connections:1\r\n")
+
+	// 空闲超过timeout的客户端在clientsCron中被关闭
+	c := server.clientList[0]
+	clientsCron()
+	assert.Zero(t, c.flags&CLIENT_CLOSED)
+	c.lastInteraction -= 11
+	clientsCron()
+	assert.NotZero(t, c.flags&CLIENT_CLOSED)
+	assert.Equal(t, 0, len(server.clients))
+	assert.Equal(t, 0, len(server.clientList))
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	// 上次异常退出留下的socket文件在启动时被清理
+	stale, err := UnixServer(path, 0)
+	assert.Nil(t, err)
+	Close(stale)
+	// 配置相对路径时CLIENT LIST中显示绝对路径，MONITOR中显示配置的路径
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	rel, err := filepath.Rel(wd, path)
+	assert.Nil(t, err)
+	conf := Config{Unixsocket: rel, Unixsocketperm: 0700}
+	assert.Nil(t, initServer(&conf))
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	flags, err := unix.FcntlInt(uintptr(server.sofd), unix.F_GETFD, 0)
+	assert.Nil(t, err)
+	assert.NotZero(t, flags&unix.FD_CLOEXEC)
+	monitor, monitorPeer := newTestClientPair(t, "127.0.0.1:1000")
+	ReadQuery(monitor, "monitor\r\n")
+	assert.Nil(t, ProcessQueryBuf(monitor))
+	assert.Equal(t, "+OK\r\n", takeReply(monitor))
+
+	s, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer Close(s)
+	assert.Nil(t, unix.Connect(s, &unix.SockaddrUnix{Name: path}))
+	AcceptHandler(server.aeLoop, server.sofd, nil)
+	assert.Equal(t, 2, len(server.clientList))
+	c := server.clientList[1]
+	assert.NotZero(t, c.flags&CLIENT_UNIX_SOCKET)
+	assert.Contains(t, catClientInfoString(c), "addr="+path+":0 laddr="+path+":0 ")
+
+	_, err = Write(s, []byte("set k v\r\n"))
+	assert.Nil(t, err)
+	ReadQueryFromClient(server.aeLoop, c.fd, c)
+	handleClientsWithPendingWrites()
+	buf := make([]byte, 64)
+	n, err := Read(s, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", string(buf[:n]))
+	buf = make([]byte, 256)
+	n, err = Read(monitorPeer, buf)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf[:n]), " [0 unix:"+rel+"] \"set\" \"k\" \"v\"\r\n")
+
+	closeListeningSockets()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// 同名的普通文件不会被当成残留的socket删除
+	assert.Nil(t, os.WriteFile(path, nil, 0644))
+	_, err = UnixServer(path, 0)
+	assert.NotNil(t, err)
+}
+
+func TestBindAddrs(t *testing.T) {
+	// 不存在的可选地址被跳过，必须的地址绑定失败时报错
+	conf := Config{Bind: []string{"127.0.0.1", "-::1", "-192.0.2.1"}}
+	assert.Nil(t, initServer(&conf))
+	assert.Equal(t, 2, len(server.ipfd))
+	for _, fd := range server.ipfd {
+		sa, err := unix.Getsockname(fd)
+		assert.Nil(t, err)
+		switch addr := sa.(type) {
+		case *unix.SockaddrInet4:
+			cfd, err := Connect("127.0.0.1", addr.Port)
+			assert.Nil(t, err)
+			defer Close(cfd)
+		case *unix.SockaddrInet6:
+			cfd, err := Connect("::1", addr.Port)
+			assert.Nil(t, err)
+			defer Close(cfd)
+		}
+		AcceptHandler(server.aeLoop, fd, nil)
+	}
+	assert.Equal(t, 2, len(server.clientList))
+	assert.True(t, strings.HasPrefix(server.clientList[0].addr, "127.0.0.1:"))
+	assert.True(t, strings.HasPrefix(server.clientList[1].addr, "[::1]:"))
+	assert.True(t, strings.HasPrefix(server.clientList[1].laddr, "[::1]:"))
+	for len(server.clientList) > 0 {
+		freeClient(server.clientList[0])
+	}
+	closeListeningSockets()
+
+	conf = Config{Bind: []string{"127.0.0.1", "192.0.2.1"}}
+	assert.NotNil(t, initServer(&conf))
+	assert.Equal(t, 0, len(server.ipfd))
+}
+
+func TestProtectedMode(t *testing.T) {
+	var external string
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			external = ipnet.IP.String()
+			break
+		}
+	}
+	if external == "" {
+		t.Skip("no non-loopback IPv4 address")
+	}
+	conf := Config{ProtectedMode: true}
+	assert.Nil(t, initServer(&conf))
+	sa, err := unix.Getsockname(server.ipfd[0])
+	assert.Nil(t, err)
+	port := sa.(*unix.SockaddrInet4).Port
+
+	// 本机的连接不受影响
+	local, err := Connect("127.0.0.1", port)
+	assert.Nil(t, err)
+	defer Close(local)
+	AcceptHandler(server.aeLoop, server.ipfd[0], nil)
+	assert.Equal(t, 1, len(server.clientList))
+
+	remote, err := Connect(external, port)
+	assert.Nil(t, err)
+	defer Close(remote)
+	AcceptHandler(server.aeLoop, server.ipfd[0], nil)
+	assert.Equal(t, 1, len(server.clientList))
+	buf := make([]byte, len(protectedModeErr)+1)
+	n := 0
+	for n < len(protectedModeErr) {
+		m, err := Read(remote, buf[n:])
+		assert.Nil(t, err)
+		if m == 0 {
+			break
+		}
+		n += m
+	}
+	assert.Equal(t, protectedModeErr, string(buf[:n]))
+	assert.Contains(t, genInfoString([]string{"stats"}), "rejected_connections:1\r\n")
+	closeListeningSockets()
+
+	// 设置了密码之后接受外部的连接
+	conf = Config{ProtectedMode: true, Requirepass: "secret"}
+	assert.Nil(t, initServer(&conf))
+	sa, err = unix.Getsockname(server.ipfd[0])
+	assert.Nil(t, err)
+	remote2, err := Connect(external, sa.(*unix.SockaddrInet4).Port)
+	assert.Nil(t, err)
+	defer Close(remote2)
+	AcceptHandler(server.aeLoop, server.ipfd[0], nil)
+	assert.Equal(t, 1, len(server.clientList))
+	closeListeningSockets()
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type CmdType = byte
@@ -20,9 +27,11 @@ const (
 )
 
 const (
-	IO_BUF     int = 1024 * 16 // iobuf长度
-	MAX_BULK   int = 1024 * 4  // bulk最长
-	MAX_INLINE int = 1024 * 4  // 限制一个inline多长
+	IO_BUF              int = 1024 * 16   // iobuf长度
+	MAX_INLINE          int = 1024 * 4    // 限制一个inline多长
+	MAX_MULTIBULK_LEN   int = 1024 * 1024 // 一条命令最多的参数个数
+	PROTO_MBULK_BIG_ARG int = 1024 * 32   // 超过这个长度的参数按声明的长度预先分配缓冲区
+	MAX_ARGS_PREALLOC   int = 1024        // 按照声明的参数个数预分配的上限，头部很短，不能完全相信它
 )
 
 type GoRedisDB struct {
@@ -31,42 +40,367 @@ type GoRedisDB struct {
 }
 
 type GoRedisServer struct {
-	fd      int
-	port    int
-	db      *GoRedisDB
-	clients map[int]*GoRedisClient
-	aeLoop  *AeLoop
+	ipfd                []int // 每个bind地址一个监听的fd
+	sofd                int   // unix socket监听的fd，没有配置时为-1
+	tlsfd               []int // tls-port在每个bind地址上监听的fd
+	tlsConfig           *tls.Config
+	tlsPendingClients   []*GoRedisClient
+	shutdownAsap        atomic.Int32 // 收到了SIGTERM/SIGINT，在ServerCron中开始关闭
+	shutdownFlags       int
+	shutdownMstime      int64 // 不为0表示正在关闭，等待回复发送完的截止时间
+	shutdownClients     []*GoRedisClient
+	expireTimelimitExit bool      // 上一次activeExpireCycle因为超时退出
+	expireLastFastCycle time.Time // 上一次快速清理的开始时间
+	port                int
+	db                  *GoRedisDB
+	clients             map[int]*GoRedisClient
+	clientList          []*GoRedisClient // 按照连接顺序排列的客户端，clientsCron从clientsCronPos开始轮流检查
+	clientsCronPos      int
+	maxclients          int              // 实际生效的最大连接数，受限于RLIMIT_NOFILE可能比配置的小
+	monitors            []*GoRedisClient // 处于MONITOR模式的客户端
+	clientsToClose      []*GoRedisClient // 等待异步关闭的客户端
+	clientsPendingWrite []*GoRedisClient // 有回复等待在beforeSleep中写出的客户端
+	clientsPendingRead  []*GoRedisClient // 开启io-threads时等待在beforeSleep中读取的客户端
+	ioThreads           []*ioThread      // 第0个是主goroutine，没有开启io-threads时为空
+	clientPauseType     int              // CLIENT_PAUSE_*，clientPauses中最严格的暂停
+	clientPauseEndTime  int64            // ms，暂停结束的时间
+	clientPauses        [NUM_PAUSE_PURPOSES]clientPause
+	pausedClients       []*GoRedisClient // 暂停期间被推迟执行命令的客户端
+	unblockedClients    []*GoRedisClient // 暂停结束后等待继续执行的客户端
+	nextClientId        int64
+	commands            map[string]*GoRedisCommand
+	aeLoop              *AeLoop
+	config              *Config
+	configFile          string
+	runId               string
+	startTime           time.Time
+	stat                serverStats
+}
+
+// 客户端状态标志
+const (
+	CLIENT_MONITOR             int = 1 << 0  // 处于MONITOR模式
+	CLIENT_CLOSE_AFTER_REPLY   int = 1 << 1  // 回复发送完之后关闭连接
+	CLIENT_CLOSE_ASAP          int = 1 << 2  // 等待在ServerCron中异步关闭
+	CLIENT_CLOSED              int = 1 << 3  // 已经释放，残留的事件需要忽略
+	CLIENT_PENDING_WRITE       int = 1 << 4  // 已经在clientsPendingWrite中，等待beforeSleep写出回复
+	CLIENT_REPLICA             int = 1 << 5  // 从库的连接
+	CLIENT_MASTER              int = 1 << 6  // 主库的连接
+	CLIENT_PUBSUB              int = 1 << 7  // 处于订阅模式
+	CLIENT_BLOCKED             int = 1 << 8  // 命令被CLIENT PAUSE推迟执行
+	CLIENT_NO_EVICT            int = 1 << 9  // CLIENT NO-EVICT ON
+	CLIENT_REPLY_OFF           int = 1 << 10 // CLIENT REPLY OFF，不发送任何回复
+	CLIENT_REPLY_SKIP_NEXT     int = 1 << 11 // CLIENT REPLY SKIP，跳过下一条命令的回复
+	CLIENT_REPLY_SKIP          int = 1 << 12 // 正在执行的命令不回复
+	CLIENT_UNIX_SOCKET         int = 1 << 13 // 通过unix socket连接
+	CLIENT_TLS_PENDING         int = 1 << 14 // crypto/tls中还有没读出来的数据，已经在tlsPendingClients中
+	CLIENT_PENDING_READ        int = 1 << 15 // 已经在clientsPendingRead中，等待IO线程读取
+	CLIENT_CLOSE_AFTER_COMMAND int = 1 << 16 // 命令执行完、回复加入之后再设置CLIENT_CLOSE_AFTER_REPLY
+)
+
+// 客户端类别，用于输出缓冲区限制以及CLIENT LIST/KILL的过滤
+const (
+	CLIENT_TYPE_NORMAL  int = 0
+	CLIENT_TYPE_REPLICA int = 1
+	CLIENT_TYPE_PUBSUB  int = 2
+	CLIENT_TYPE_MASTER  int = 3
+	CLIENT_TYPE_COUNT   int = 4
+)
+
+var clientTypeNames = [CLIENT_TYPE_COUNT]string{"normal", "replica", "pubsub", "master"}
+
+// getClientType MONITOR客户端按照普通客户端对待
+func getClientType(c *GoRedisClient) int {
+	if c.flags&CLIENT_MASTER != 0 {
+		return CLIENT_TYPE_MASTER
+	}
+	if c.flags&CLIENT_REPLICA != 0 && c.flags&CLIENT_MONITOR == 0 {
+		return CLIENT_TYPE_REPLICA
+	}
+	if c.flags&CLIENT_PUBSUB != 0 {
+		return CLIENT_TYPE_PUBSUB
+	}
+	return CLIENT_TYPE_NORMAL
+}
+
+// getClientTypeByName slave是replica的旧名字，找不到返回-1
+func getClientTypeByName(name string) int {
+	name = strings.ToLower(name)
+	if name == "slave" {
+		return CLIENT_TYPE_REPLICA
+	}
+	for i, n := range clientTypeNames {
+		if n == name {
+			return i
+		}
+	}
+	return -1
 }
 
 type GoRedisClient struct {
-	fd       int
-	db       *GoRedisDB
-	args     []*GObj
-	reply    *List
-	sentLen  int // 一个GObj可能不能发送完毕，此时用于记录断点，用于下次发送，即记录replylist第一个元素已经发送的部分
-	queryBuf []byte
-	queryLen int // 未处理的命令的长度
-	cmdTy    CmdType
-	bulkNum  int // multi模式下数组的长度
-	bulkLen  int // multi模式下数组的子元素的长度
+	id                       int64
+	fd                       int
+	resp                     int // 协议版本，RESP2或者RESP3
+	flags                    int
+	addr                     string   // 对端地址
+	laddr                    string   // 本端地址
+	tls                      *tlsConn // TLS连接，普通连接为nil
+	ctime                    int64    // 连接建立的时间，单位秒
+	name                     string   // CLIENT SETNAME设置的名字
+	user                     *aclUser
+	authenticated            bool
+	db                       *GoRedisDB
+	args                     []*GObj
+	lastCmd                  *GoRedisCommand // 最近一次执行的命令
+	buf                      []byte          // 固定大小的回复缓冲区，len是已经写入的长度
+	reply                    []*replyBlock   // buf写满之后回复追加到这里
+	replyBytes               int64           // reply中所有块的总长度
+	obufSoftLimitReachedTime int64           // 第一次超过soft limit的时间，单位秒，0表示没有超过
+	lastInteraction          int64           // 最后一次读写的时间，单位秒，用于timeout
+	sentLen                  int             // buf或者reply第一个块已经发送的长度，一次write不一定能发送完
+	queryBuf                 []byte
+	qbPos                    int // queryBuf中已经解析到的位置，[qbPos, queryLen)是还没有处理的数据
+	queryLen                 int // queryBuf中有效数据的长度
+	cmdTy                    CmdType
+	bulkNum                  int // multi模式下数组的长度
+	bulkLen                  int // multi模式下数组的子元素的长度，-1表示还没有读到
 }
 
 type CommandProc func(c *GoRedisClient)
 
 // do not support bulk command
 type GoRedisCommand struct {
-	name  string
-	proc  CommandProc
-	arity int
+	name          string
+	proc          CommandProc
+	arity         int // 负数表示至少-arity个参数
+	flags         int // CMD_*
+	aclCategories int // ACL_CATEGORY_*，由flags推导的分类不需要重复声明
+	keySpecs      []keySpec
+	channelSpecs  []channelSpec // 发布订阅类命令的频道参数
+	tips          []string
+	subcommands   []GoRedisCommand
+	// COMMAND DOCS 使用的文档
+	summary    string
+	since      string
+	group      string
+	complexity string
+
+	parent          *GoRedisCommand
+	subcommandsDict map[string]*GoRedisCommand
+	calls           int64 // 调用次数
+	microseconds    int64 // 累计耗时
 }
 
 // Global Varibles
 var server GoRedisServer
 
 var cmdTable []GoRedisCommand = []GoRedisCommand{
-	{"get", getCommand, 2},
-	{"set", setCommand, 3},
-	{"expire", expireCommand, 3},
+	{
+		name: "get", proc: getCommand, arity: 2,
+		flags:         CMD_READONLY | CMD_FAST,
+		aclCategories: ACL_CATEGORY_STRING,
+		keySpecs:      []keySpec{{flags: KSPEC_RO | KSPEC_ACCESS, beginIndex: 1, lastKey: 0, keyStep: 1}},
+		summary:       "Returns the string value of a key.", since: "1.0.0", group: "string", complexity: "O(1)",
+	},
+	{
+		name: "set", proc: setCommand, arity: 3,
+		flags:         CMD_WRITE | CMD_DENYOOM,
+		aclCategories: ACL_CATEGORY_STRING,
+		keySpecs:      []keySpec{{flags: KSPEC_RW | KSPEC_ACCESS | KSPEC_UPDATE, beginIndex: 1, lastKey: 0, keyStep: 1}},
+		summary:       "Sets the string value of a key, ignoring its type.", since: "1.0.0", group: "string", complexity: "O(1)",
+	},
+	{
+		name: "expire", proc: expireCommand, arity: 3,
+		flags:         CMD_WRITE | CMD_FAST,
+		aclCategories: ACL_CATEGORY_KEYSPACE,
+		keySpecs:      []keySpec{{flags: KSPEC_RW | KSPEC_UPDATE, beginIndex: 1, lastKey: 0, keyStep: 1}},
+		summary:       "Sets the expiration time of a key in seconds.", since: "1.0.0", group: "generic", complexity: "O(1)",
+	},
+	{
+		name: "info", proc: infoCommand, arity: -1,
+		flags:   CMD_LOADING | CMD_STALE,
+		tips:    []string{"nondeterministic_output"},
+		summary: "Returns information and statistics about the server.", since: "1.0.0", group: "server", complexity: "O(1)",
+	},
+	{
+		name: "slowlog", arity: -2,
+		summary: "A container for slow log commands.", since: "2.2.12", group: "server", complexity: "Depends on subcommand.",
+		subcommands: []GoRedisCommand{
+			{
+				name: "get", proc: slowlogCommand, arity: -2, flags: CMD_ADMIN | CMD_LOADING | CMD_STALE,
+				tips:    []string{"nondeterministic_output"},
+				summary: "Returns the slow log's entries.", since: "2.2.12", group: "server", complexity: "O(N) where N is the number of entries returned",
+			},
+			{
+				name: "len", proc: slowlogCommand, arity: 2, flags: CMD_ADMIN | CMD_LOADING | CMD_STALE,
+				tips:    []string{"nondeterministic_output"},
+				summary: "Returns the number of entries in the slow log.", since: "2.2.12", group: "server", complexity: "O(1)",
+			},
+			{
+				name: "reset", proc: slowlogCommand, arity: 2, flags: CMD_ADMIN | CMD_LOADING | CMD_STALE,
+				summary: "Clears all entries from the slow log.", since: "2.2.12", group: "server", complexity: "O(N) where N is the number of entries in the slowlog",
+			},
+			{
+				name: "help", proc: slowlogCommand, arity: 2, flags: CMD_LOADING | CMD_STALE,
+				summary: "Show helpful text about the different subcommands.", since: "6.2.0", group: "server", complexity: "O(1)",
+			},
+		},
+	},
+	{
+		name: "monitor", proc: monitorCommand, arity: 1,
+		flags:   CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+		summary: "Listens for all requests received by the server in real-time.", since: "1.0.0", group: "server", complexity: "",
+	},
+	{
+		name: "auth", proc: authCommand, arity: -2,
+		flags:         CMD_NOSCRIPT | CMD_LOADING | CMD_STALE | CMD_FAST | CMD_NO_AUTH | CMD_SKIP_MONITOR | CMD_SKIP_SLOWLOG,
+		aclCategories: ACL_CATEGORY_CONNECTION,
+		summary:       "Authenticates the connection.", since: "1.0.0", group: "connection", complexity: "O(N) where N is the number of passwords defined for the user",
+	},
+	{
+		name: "acl", arity: -2,
+		summary: "A container for Access List Control commands.", since: "6.0.0", group: "server", complexity: "Depends on subcommand.",
+		subcommands: []GoRedisCommand{
+			{
+				name: "setuser", proc: aclCommand, arity: -3, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Creates and modifies an ACL user and its rules.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of rules provided.",
+			},
+			{
+				name: "getuser", proc: aclCommand, arity: 3, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Lists the ACL rules of a user.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of password, command and pattern rules that the user has.",
+			},
+			{
+				name: "deluser", proc: aclCommand, arity: -3, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Deletes ACL users, and terminates their connections.", since: "6.0.0", group: "server", complexity: "O(1) amortized time considering the typical user.",
+			},
+			{
+				name: "list", proc: aclCommand, arity: 2, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Dumps the effective rules in ACL file format.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+			},
+			{
+				name: "users", proc: aclCommand, arity: 2, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Lists all ACL users.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+			},
+			{
+				name: "whoami", proc: aclCommand, arity: 2, flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Returns the authenticated username of the current connection.", since: "6.0.0", group: "server", complexity: "O(1)",
+			},
+			{
+				name: "cat", proc: aclCommand, arity: -2, flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Lists the ACL categories, or the commands inside a category.", since: "6.0.0", group: "server", complexity: "O(1) since the categories and commands are a fixed set.",
+			},
+			{
+				name: "log", proc: aclCommand, arity: -2, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Lists recent security events generated due to ACL rules.", since: "6.0.0", group: "server", complexity: "O(N) with N being the number of entries shown.",
+			},
+			{
+				name: "save", proc: aclCommand, arity: 2, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Saves the effective ACL rules in the configured ACL file.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+			},
+			{
+				name: "load", proc: aclCommand, arity: 2, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+				summary: "Reloads the rules from the configured ACL file.", since: "6.0.0", group: "server", complexity: "O(N). Where N is the number of configured users.",
+			},
+			{
+				name: "help", proc: aclCommand, arity: 2, flags: CMD_LOADING | CMD_STALE,
+				summary: "Returns helpful text about the different subcommands.", since: "6.0.0", group: "server", complexity: "O(1)",
+			},
+		},
+	},
+	{
+		name: "shutdown", proc: shutdownCommand, arity: -1,
+		flags:   CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE,
+		summary: "Synchronously saves the database(s) to disk and shuts down the Redis server.", since: "1.0.0", group: "server", complexity: "O(N) when saving, where N is the total number of keys in all databases when saving data, otherwise O(1)",
+	},
+	{
+		name: "hello", proc: helloCommand, arity: -1,
+		flags:         CMD_NOSCRIPT | CMD_LOADING | CMD_STALE | CMD_FAST | CMD_NO_AUTH | CMD_SKIP_MONITOR | CMD_SKIP_SLOWLOG,
+		aclCategories: ACL_CATEGORY_CONNECTION,
+		summary:       "Handshakes with the Redis server.", since: "6.0.0", group: "connection", complexity: "O(1)",
+	},
+	{
+		name: "client", arity: -2,
+		summary: "A container for client connection commands.", since: "2.4.0", group: "connection", complexity: "Depends on subcommand.",
+		subcommands: []GoRedisCommand{
+			{
+				name: "id", proc: clientCommand, arity: 2, flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Returns the unique client ID of the connection.", since: "5.0.0", group: "connection", complexity: "O(1)",
+			},
+			{
+				name: "info", proc: clientCommand, arity: 2, flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				tips:    []string{"nondeterministic_output"},
+				summary: "Returns information about the connection.", since: "6.2.0", group: "connection", complexity: "O(1)",
+			},
+			{
+				name: "list", proc: clientCommand, arity: -2, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				tips:    []string{"nondeterministic_output"},
+				summary: "Lists open connections.", since: "2.4.0", group: "connection", complexity: "O(N) where N is the number of client connections",
+			},
+			{
+				name: "kill", proc: clientCommand, arity: -3, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Terminates open connections.", since: "2.4.0", group: "connection", complexity: "O(N) where N is the number of client connections",
+			},
+			{
+				name: "setname", proc: clientCommand, arity: 3, flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Sets the connection name.", since: "2.6.9", group: "connection", complexity: "O(1)",
+			},
+			{
+				name: "getname", proc: clientCommand, arity: 2, flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Returns the name of the connection.", since: "2.6.9", group: "connection", complexity: "O(1)",
+			},
+			{
+				name: "pause", proc: clientCommand, arity: -3, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Suspends commands processing.", since: "3.0.0", group: "connection", complexity: "O(1)",
+			},
+			{
+				name: "unpause", proc: clientCommand, arity: 2, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Resumes processing commands from paused clients.", since: "6.2.0", group: "connection", complexity: "O(N) Where N is the number of paused clients",
+			},
+			{
+				name: "reply", proc: clientCommand, arity: 3, flags: CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Instructs the server whether to reply to commands.", since: "3.2.0", group: "connection", complexity: "O(1)",
+			},
+			{
+				name: "no-evict", proc: clientCommand, arity: 3, flags: CMD_ADMIN | CMD_NOSCRIPT | CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Sets the client eviction mode of the connection.", since: "7.0.0", group: "connection", complexity: "O(1)",
+			},
+			{
+				name: "help", proc: clientCommand, arity: 2, flags: CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Returns helpful text about the different subcommands.", since: "5.0.0", group: "connection", complexity: "O(1)",
+			},
+		},
+	},
+	{
+		name: "command", proc: commandCommand, arity: -1,
+		flags:         CMD_LOADING | CMD_STALE,
+		aclCategories: ACL_CATEGORY_CONNECTION,
+		tips:          []string{"nondeterministic_output_order"},
+		summary:       "Returns detailed information about all commands.", since: "2.8.13", group: "server", complexity: "O(N) where N is the total number of Redis commands",
+		subcommands: []GoRedisCommand{
+			{
+				name: "count", proc: commandCommand, arity: 2, flags: CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Returns a count of commands.", since: "2.8.13", group: "server", complexity: "O(1)",
+			},
+			{
+				name: "info", proc: commandCommand, arity: -2, flags: CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				tips:    []string{"nondeterministic_output_order"},
+				summary: "Returns information about one, multiple or all commands.", since: "2.8.13", group: "server", complexity: "O(N) where N is the number of commands to look up",
+			},
+			{
+				name: "docs", proc: commandCommand, arity: -2, flags: CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				tips:    []string{"nondeterministic_output_order"},
+				summary: "Returns documentary information about one, multiple or all commands.", since: "7.0.0", group: "server", complexity: "O(N) where N is the number of commands to look up",
+			},
+			{
+				name: "getkeys", proc: commandCommand, arity: -3, flags: CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Extracts the key names from an arbitrary command.", since: "2.8.13", group: "server", complexity: "O(N) where N is the number of arguments to the command",
+			},
+			{
+				name: "help", proc: commandCommand, arity: 2, flags: CMD_LOADING | CMD_STALE, aclCategories: ACL_CATEGORY_CONNECTION,
+				summary: "Returns helpful text about the different subcommands.", since: "5.0.0", group: "server", complexity: "O(1)",
+			},
+		},
+	},
 }
 
 func getCommand(c *GoRedisClient) {
@@ -74,73 +408,88 @@ func getCommand(c *GoRedisClient) {
 	val := findKeyRead(key)
 	// 找有没有这个key,可能会过期
 	if val == nil {
-		// TODO: extract shared.strings
-		c.AddReplyStr("$-1\r\n")
+		c.AddReplyNull()
 	} else if val.Type_ != GSTR {
-		// TODO: extract shared.strings
 		// 不是stirng类型，应该用其他的命令获取
-		c.AddReplyStr("-ERR: wrong type\r\n")
+		c.AddReplyErrorObject(shared.wrongTypeErr)
 	} else {
-		str := val.StrVal()
 		// 返回value
-		c.AddReplyStr(fmt.Sprintf("$%d%v\r\n", len(str), str))
+		c.AddReplyBulk(val.StrVal())
 	}
 }
 
 func setCommand(c *GoRedisClient) {
 	key := c.args[1]
 	val := c.args[2]
-	if val.Type_ != GSTR {
-		// TODO: extract shared.strings
-		c.AddReplyStr("-ERR: wrong type\r\n")
-	}
 	server.db.data.Set(key, val)
 	server.db.expire.Delete(key)
-	c.AddReplyStr("+OK\r\n")
+	c.AddReply(shared.ok)
 }
 
+// expireCommand EXPIRE key seconds，key不存在时回复0
 func expireCommand(c *GoRedisClient) {
 	key := c.args[1]
-	val := c.args[2]
-	if val.Type_ != GSTR {
-		// TODO: extract shared.strings
-		c.AddReplyStr("-ERR: wrong type\r\n")
+	seconds, err := strconv.ParseInt(c.args[2].StrVal(), 10, 64)
+	if err != nil {
+		c.AddReplyErrorObject(shared.notIntegerErr)
+		return
+	}
+	if findKeyWrite(key) == nil {
+		c.AddReply(shared.czero)
+		return
 	}
 	// 转换成毫秒
-	expire := GetMsTime() + (val.IntVal() * 1000)
+	expire := GetMsTime() + seconds*1000
 	expObj := CreateFromInt(expire)
 	server.db.expire.Set(key, expObj)
 	expObj.DecrRefCount()
-	c.AddReplyStr("+OK\r\n")
+	c.AddReply(shared.cone)
 }
 
-func findKeyRead(key *GObj) *GObj {
-	expireIfNeeded(key)
+// findKeyWrite 写命令查找key，过期的key同样会被删除，但是不计入keyspace_hits/misses
+func findKeyWrite(key *GObj) *GObj {
+	if expireIfNeeded(key) {
+		return nil
+	}
 	return server.db.data.Get(key)
 }
 
-// expireIfNeeded 检查是否已经过期
-func expireIfNeeded(key *GObj) {
+func findKeyRead(key *GObj) *GObj {
+	val := findKeyWrite(key)
+	if val == nil {
+		server.stat.keyspaceMisses++
+	} else {
+		server.stat.keyspaceHits++
+	}
+	return val
+}
+
+// deleteExpiredKey 删除一个已过期的key
+func deleteExpiredKey(key *GObj) {
+	// key可能是expire字典中entry的key，先增加引用防止删除过程中被清空
+	key.IncrRefCount()
+	_ = server.db.expire.Delete(key)
+	_ = server.db.data.Delete(key)
+	key.DecrRefCount()
+	server.stat.expiredKeys++
+}
+
+// expireIfNeeded 检查是否已经过期，过期返回true
+func expireIfNeeded(key *GObj) bool {
 	entry := server.db.expire.Find(key)
 	if entry == nil {
-		return
+		return false
 	}
 	when := entry.Val.IntVal()
 	if when > GetMsTime() {
-		return
+		return false
 	}
-	_ = server.db.expire.Delete(key)
-	_ = server.db.data.Delete(key)
-}
-
-func lookupCommand(cmdStr string) *GoRedisCommand {
-	// TODO 忽略大小写
-	for _, c := range cmdTable {
-		if strings.EqualFold(c.name, cmdStr) {
-			return &c
-		}
+	// CLIENT PAUSE 期间数据不能有变化，过期的key先不删除，但是对客户端表现为不存在
+	if server.clientPauseType != CLIENT_PAUSE_OFF {
+		return true
 	}
-	return nil
+	deleteExpiredKey(key)
+	return true
 }
 
 func ProcessCommand(client *GoRedisClient) {
@@ -150,184 +499,389 @@ func ProcessCommand(client *GoRedisClient) {
 		freeClient(client)
 		return
 	}
-	defer resetClient(client)
+	defer func() {
+		// 被推迟的命令等暂停结束后还要重新执行
+		if client.flags&CLIENT_BLOCKED == 0 {
+			resetClient(client)
+		}
+	}()
 	cmd := lookupCommand(cmdStr)
 	if cmd == nil {
-		client.AddReplyStr("-ERR: unknow command\r\n")
+		var args strings.Builder
+		for _, arg := range client.args[1:] {
+			fmt.Fprintf(&args, "'%.128s' ", arg.StrVal())
+		}
+		client.AddReplyErrorFormat("unknown command '%.128s', with args beginning with: %s", cmdStr, args.String())
+		return
+	}
+	// 容器命令，例如 slowlog get，实际执行的是子命令
+	if len(cmd.subcommands) > 0 && len(client.args) >= 2 {
+		sub := cmd.lookupSubcommand(client.args[1].StrVal())
+		if sub == nil {
+			client.AddReplyErrorFormat("unknown subcommand '%.128s'. Try %s HELP.",
+				client.args[1].StrVal(), strings.ToUpper(cmd.name))
+			return
+		}
+		cmd = sub
+	}
+	client.lastCmd = cmd
+	if !cmd.checkArity(len(client.args)) {
+		client.AddReplyErrorFormat("wrong number of arguments for '%s' command", cmd.fullName())
 		return
-	} else if cmd.arity != len(client.args) {
-		client.AddReplyStr("-ERR: wrong number of args\r\n")
+	}
+	if authRequired(client) && cmd.flags&CMD_NO_AUTH == 0 {
+		client.AddReplyErrorObject(shared.noAuthErr)
 		return
 	}
+	if ok, reason, object := aclCheckAllPerm(client.user, cmd, client.args); !ok {
+		addACLLogEntry(client, reason, "toplevel", object, "")
+		switch reason {
+		case ACL_DENIED_CMD:
+			client.AddReplyErrorFormat("-NOPERM User %s has no permissions to run the '%s' command",
+				client.username(), cmd.fullName())
+		case ACL_DENIED_CHANNEL:
+			client.AddReplyErrorObject(shared.noPermChannelErr)
+		default:
+			client.AddReplyErrorObject(shared.noPermKeyErr)
+		}
+		return
+	}
+	if shouldPauseCommand(client, cmd) {
+		blockPostponeClient(client)
+		return
+	}
+	replicationFeedMonitors(client, cmd)
+	start := time.Now()
 	cmd.proc(client)
+	duration := time.Since(start).Microseconds()
+	cmd.calls++
+	cmd.microseconds += duration
+	server.stat.numCommands++
+	slowlogPushEntryIfNeeded(client, cmd, duration)
+	// 命令断开了自己的连接，这时回复已经加入，可以标记为发送完就关闭
+	if client.flags&CLIENT_CLOSE_AFTER_COMMAND != 0 {
+		client.flags &= ^CLIENT_CLOSE_AFTER_COMMAND
+		closeClientAfterReply(client)
+	}
 }
 
+// freeArgs 释放上一条命令的参数，参数数组留给下一条命令复用
 func freeArgs(client *GoRedisClient) {
-	for _, v := range client.args {
+	for i, v := range client.args {
 		v.DecrRefCount()
+		client.args[i] = nil
 	}
+	client.args = client.args[:0]
 }
 
 func freeReplyList(client *GoRedisClient) {
-	for client.reply.length != 0 {
-		n := client.reply.head
-		client.reply.DelNode(n)
-		n.Val.DecrRefCount()
-	}
+	client.buf = client.buf[:0]
+	client.reply = nil
+	client.replyBytes = 0
+	client.sentLen = 0
 }
 
 func freeClient(client *GoRedisClient) {
+	if client.flags&CLIENT_CLOSED != 0 {
+		return
+	}
+	client.flags |= CLIENT_CLOSED
 	freeArgs(client)
-	delete(server.clients, client.fd)
+	if client.flags&CLIENT_MONITOR != 0 {
+		removeMonitor(client)
+	}
+	unlinkClient(client)
 	server.aeLoop.RemoveFileEvent(client.fd, AE_READABLE)
 	server.aeLoop.RemoveFileEvent(client.fd, AE_WRITABLE)
 	freeReplyList(client)
+	if client.tls != nil {
+		client.tls.close()
+	}
 	Close(client.fd)
 }
 
+// linkClient 把新连接的客户端加入到server中
+func linkClient(client *GoRedisClient) {
+	server.clients[client.fd] = client
+	server.clientList = append(server.clientList, client)
+}
+
+func unlinkClient(client *GoRedisClient) {
+	delete(server.clients, client.fd)
+	for i, c := range server.clientList {
+		if c == client {
+			server.clientList = append(server.clientList[:i], server.clientList[i+1:]...)
+			// 保证clientsCron不会跳过被删除的客户端后面那个
+			if i < server.clientsCronPos {
+				server.clientsCronPos--
+			}
+			break
+		}
+	}
+}
+
+// freeClientAsync 不能马上释放的客户端，例如正在遍历clients时，放到队列中稍后释放
+func freeClientAsync(client *GoRedisClient) {
+	if client.flags&(CLIENT_CLOSE_ASAP|CLIENT_CLOSED) != 0 {
+		return
+	}
+	client.flags |= CLIENT_CLOSE_ASAP
+	server.clientsToClose = append(server.clientsToClose, client)
+}
+
+func freeClientsInAsyncFreeQueue() {
+	for _, c := range server.clientsToClose {
+		freeClient(c)
+	}
+	server.clientsToClose = nil
+}
+
+// disconnectClient 断开other，如果other就是正在执行命令的客户端，则等命令的回复发送完再关闭。
+// 不能直接设置CLIENT_CLOSE_AFTER_REPLY，否则命令后面加入的回复会被丢掉
+func disconnectClient(other, current *GoRedisClient) {
+	if other == current {
+		other.flags |= CLIENT_CLOSE_AFTER_COMMAND
+	} else {
+		freeClientAsync(other)
+	}
+}
+
+// closeClientAfterReply 回复发送完之后关闭连接，必须在回复加入之后调用。
+// 没有回复(例如CLIENT REPLY OFF)时也放进clientsPendingWrite，由beforeSleep关闭
+func closeClientAfterReply(c *GoRedisClient) {
+	c.flags |= CLIENT_CLOSE_AFTER_REPLY
+	if c.flags&CLIENT_PENDING_WRITE == 0 && !c.hasPendingReplies() {
+		c.flags |= CLIENT_PENDING_WRITE
+		server.clientsPendingWrite = append(server.clientsPendingWrite, c)
+	}
+}
+
+func (c *GoRedisClient) username() string {
+	if c.user == nil {
+		return ACL_DEFAULT_USER
+	}
+	return c.user.name
+}
+
 func resetClient(client *GoRedisClient) {
 	client.cmdTy = COMMAND_UNKNOW
+	// CLIENT REPLY SKIP 只跳过它后面那一条命令的回复
+	if client.flags&CLIENT_REPLY_SKIP != 0 {
+		client.flags &= ^CLIENT_REPLY_SKIP
+	}
+	if client.flags&CLIENT_REPLY_SKIP_NEXT != 0 {
+		client.flags |= CLIENT_REPLY_SKIP
+		client.flags &= ^CLIENT_REPLY_SKIP_NEXT
+	}
 }
 
-// findLineInQuery 找到第一个\r\n的位置
-func (c *GoRedisClient) findLineInQuery() (int, error) {
-	index := strings.Index(string(c.queryBuf[:c.queryLen]), "\r\n")
-	if index < 0 && c.queryLen > MAX_INLINE {
-		return index, errors.New("to bug inline cmd")
+// pendingQuery 返回queryBuf中还没有解析的部分，解析直接在这段内存上进行，不做拷贝
+func (c *GoRedisClient) pendingQuery() []byte {
+	return c.queryBuf[c.qbPos:c.queryLen]
+}
+
+// consumeQuery 读游标前进n字节，全部解析完时游标回到开头，下次读取不需要挪动数据
+func (c *GoRedisClient) consumeQuery(n int) {
+	c.qbPos += n
+	if c.qbPos == c.queryLen {
+		c.qbPos = 0
+		c.queryLen = 0
 	}
-	return index, nil
 }
 
-func (c *GoRedisClient) getNumInQuery(s, e int) (int, error) {
-	num, err := strconv.Atoi(string(c.queryBuf[s:e]))
-	c.queryBuf = c.queryBuf[e+2:]
-	c.queryLen -= e + 2
-	return num, err
+// makeRoomForQuery 保证queryBuf尾部至少有n字节空闲，
+// 优先把未解析的数据挪到开头复用原来的内存，不够时才重新分配
+func (c *GoRedisClient) makeRoomForQuery(n int) {
+	if len(c.queryBuf)-c.queryLen >= n {
+		return
+	}
+	pending := c.queryLen - c.qbPos
+	buf := c.queryBuf
+	if len(buf)-pending < n {
+		buf = make([]byte, pending+n)
+	}
+	copy(buf, c.queryBuf[c.qbPos:c.queryLen])
+	c.queryBuf = buf
+	c.qbPos = 0
+	c.queryLen = pending
+}
+
+// readQueryLine 读取形如 *3\r\n 或 $3\r\n 的一行中的数字，行不完整时ok为false
+func (c *GoRedisClient) readQueryLine(name string) (num int, ok bool, err error) {
+	query := c.pendingQuery()
+	index := bytes.IndexByte(query, '\r')
+	if index < 0 || index+1 >= len(query) {
+		if len(query) > MAX_INLINE {
+			return 0, false, fmt.Errorf("too big %s count string", name)
+		}
+		return 0, false, nil
+	}
+	n, valid := bytesToInt(query[1:index])
+	if !valid || query[index+1] != '\n' {
+		return 0, false, fmt.Errorf("invalid %s length", name)
+	}
+	c.consumeQuery(index + 2)
+	return n, true, nil
 }
 
+// AddReply 回复一个已经编码好的对象，一般是shared中的共享对象
 func (c *GoRedisClient) AddReply(o *GObj) {
-	c.reply.Append(o)
-	o.IncrRefCount()
-	server.aeLoop.AddFileEvent(c.fd, AE_WRITABLE, SendReplyToClient, c)
+	c.addReplyProto(o.StrVal())
 }
 
+// AddReplyStr 直接写入已经编码好的协议内容，命令应该使用reply.go中带类型的接口
 func (c *GoRedisClient) AddReplyStr(str string) {
-	o := CreateObject(GSTR, str)
-	c.AddReply(o)
-	o.DecrRefCount()
+	c.addReplyProto(str)
 }
 
+// handleInlineBuf 解析telnet发来的一行命令，引号和转义的规则和redis-cli一致
+// eg: set k "hello world"\r\n
 func handleInlineBuf(client *GoRedisClient) (bool, error) {
-	index, err := client.findLineInQuery()
-	// err是因为一个inline溢出,可能是发生了攻击
+	query := client.pendingQuery()
+	// 兼容只发送\n的客户端，例如nc
+	index := bytes.IndexByte(query, '\n')
 	if index < 0 {
-		return false, err
-	}
-	// 用空格切分
-	subs := strings.Split(string(client.queryBuf[:index]), " ")
-	// 更新buf
-	client.queryBuf = client.queryBuf[index+2:]
-	client.queryLen -= index + 2
-	// 把这段作为参数置入
-	client.args = make([]*GObj, len(subs))
-	for i, v := range subs {
-		// 创建GObj
-		client.args[i] = CreateObject(GSTR, v)
+		// 一直没有换行，可能是发生了攻击
+		if len(query) > MAX_INLINE {
+			return false, errors.New("too big inline request")
+		}
+		return false, nil
+	}
+	line := query[:index]
+	if index > 0 && line[index-1] == '\r' {
+		line = line[:index-1]
+	}
+	subs, err := splitArgs(string(line))
+	client.consumeQuery(index + 1)
+	if err != nil {
+		return false, errors.New("unbalanced quotes in request")
+	}
+	freeArgs(client)
+	for _, v := range subs {
+		client.args = append(client.args, CreateObject(GSTR, v))
 	}
 	return true, nil
 }
 
 // handleBulkBuf 解析多行 eg:*3\r\n$3\r\nSet\r\n$3\r\nKey\r\n$3\r\nVal\r\n
+// 不完整的命令会记录解析到的位置，下次从bulkNum和bulkLen继续
 func handleBulkBuf(client *GoRedisClient) (bool, error) {
 	if client.bulkNum == 0 {
-		// 找\r\n位置
-		index, err := client.findLineInQuery()
-		if index < 0 || err != nil {
-			return false, err
-		}
 		// 把形如*3\r\n的数字读出来
-		bnum, err := client.getNumInQuery(1, index)
-		if err != nil {
+		bnum, ok, err := client.readQueryLine("mbulk")
+		if !ok {
 			return false, err
 		}
-		// 数组元素为空
-		if bnum == 0 {
+		if bnum > MAX_MULTIBULK_LEN {
+			return false, errors.New("invalid multibulk length")
+		}
+		freeArgs(client)
+		// 数组元素为空，*-1也当作空命令
+		if bnum <= 0 {
 			return true, nil
 		}
 		client.bulkNum = bnum
-		client.args = make([]*GObj, client.bulkNum)
+		// 参数数组在命令之间复用，只有放不下时才重新分配，超过预分配上限的部分由append扩容
+		if cap(client.args) < bnum {
+			prealloc := bnum
+			if prealloc > MAX_ARGS_PREALLOC {
+				prealloc = MAX_ARGS_PREALLOC
+			}
+			client.args = make([]*GObj, 0, prealloc)
+		}
 	}
 	for client.bulkNum > 0 {
 		// read bulk length
-		if client.bulkLen == 0 {
-			index, err := client.findLineInQuery()
-			if index < 0 {
-				return false, err
-			}
+		if client.bulkLen < 0 {
 			// 读出形如 $3r\n\nset\r\n
-			if client.queryBuf[0] != '$' {
-				return false, errors.New("expect $ for bulk length")
+			if query := client.pendingQuery(); len(query) > 0 && query[0] != '$' {
+				return false, fmt.Errorf("expected '$', got '%c'", query[0])
 			}
 			// 该元素的长度,就是上面的3
-			blen, err := client.getNumInQuery(1, index)
-			if err != nil || blen == 0 {
+			blen, ok, err := client.readQueryLine("bulk")
+			if !ok {
 				return false, err
 			}
-			// 单条bulkLen的长度
-			if blen > MAX_BULK {
-				return false, errors.New("too big bulk")
+			if blen < 0 || int64(blen) > server.config.protoMaxBulkLen() {
+				return false, errors.New("invalid bulk length")
+			}
+			// 大参数按照声明的长度一次分配好，读完之后缓冲区里只有这个参数
+			if blen >= PROTO_MBULK_BIG_ARG && len(client.queryBuf)-client.qbPos < blen+2 {
+				buf := make([]byte, blen+2)
+				client.queryLen = copy(buf, client.pendingQuery())
+				client.queryBuf = buf
+				client.qbPos = 0
 			}
 			client.bulkLen = blen
 		}
 		// 可能未完全接受，例如$3\r\nSe
-		if client.queryLen < client.bulkLen+2 {
+		query := client.pendingQuery()
+		if len(query) < client.bulkLen+2 {
 			return false, nil
 		}
 		// 接受该bulk缓存
 		index := client.bulkLen
-		if client.queryBuf[index] != '\r' || client.queryBuf[index+1] != '\n' {
+		if query[index] != '\r' || query[index+1] != '\n' {
 			return false, errors.New("expect CRLF for bulk end")
 		}
-		// bulkNum会迭代递减
-		client.args[len(client.args)-client.bulkNum] = CreateObject(GSTR, string(client.queryBuf[:index]))
-		client.queryBuf = client.queryBuf[index+2:]
-		client.queryLen -= index + 2
-		client.bulkLen = 0
+		var arg *GObj
+		if index >= PROTO_MBULK_BIG_ARG && client.qbPos == 0 && client.queryLen == index+2 {
+			// 缓冲区里只有这个大参数，直接把缓冲区交给参数，避免再拷贝一次
+			arg = CreateObject(GSTR, bytesToString(query[:index]))
+			client.queryBuf = make([]byte, IO_BUF)
+			client.queryLen = 0
+		} else {
+			arg = CreateObject(GSTR, string(query[:index]))
+			client.consumeQuery(index + 2)
+		}
+		client.args = append(client.args, arg)
+		client.bulkLen = -1
 		client.bulkNum -= 1
 	}
 	return true, nil
 }
 
+// canProcessQuery 当有未处理的命令时，将要关闭的客户端不再处理后续命令
+func canProcessQuery(client *GoRedisClient) bool {
+	return client.queryLen > client.qbPos && client.flags&(CLIENT_BLOCKED|CLIENT_CLOSE_AFTER_REPLY|CLIENT_CLOSE_ASAP|CLIENT_CLOSED) == 0
+}
+
+// parseCommand 从queryBuf中解析一条命令到args，ok表示命令是否完整，只修改这个客户端的状态
+func parseCommand(client *GoRedisClient) (bool, error) {
+	if client.cmdTy == COMMAND_UNKNOW {
+		if client.queryBuf[client.qbPos] == '*' {
+			client.cmdTy = COMMAND_BULK
+		} else {
+			client.cmdTy = COMMAND_INLINE
+		}
+	}
+	if client.cmdTy == COMMAND_INLINE {
+		return handleInlineBuf(client)
+	} else if client.cmdTy == COMMAND_BULK {
+		return handleBulkBuf(client)
+	}
+	return false, errors.New("unknow go-redis command Type")
+}
+
+// processParsedCommand 执行已经解析好的命令，空命令只重置状态
+func processParsedCommand(client *GoRedisClient) {
+	if len(client.args) == 0 {
+		resetClient(client)
+	} else {
+		ProcessCommand(client)
+	}
+}
+
 // ProcessQueryBuf 处理命令
 func ProcessQueryBuf(client *GoRedisClient) error {
-	// 当有未处理的命令时
-	for client.queryLen > 0 {
-		if client.cmdTy == COMMAND_UNKNOW {
-			if client.queryBuf[0] == '*' {
-				client.cmdTy = COMMAND_BULK
-			} else {
-				client.cmdTy = COMMAND_INLINE
-			}
-		}
-		var ok bool
-		var err error
+	for canProcessQuery(client) {
 		// ok表示这个buff是否完整的命令，err表示执行是否出错
-		if client.cmdTy == COMMAND_INLINE {
-			ok, err = handleInlineBuf(client)
-		} else if client.cmdTy == COMMAND_BULK {
-			ok, err = handleBulkBuf(client)
-		} else {
-			return errors.New("unknow go-redis command Type")
-		}
+		ok, err := parseCommand(client)
 		if err != nil {
 			return err
 		}
 		if ok {
-			if len(client.args) == 0 {
-				resetClient(client)
-			} else {
-				ProcessCommand(client)
-			}
+			processParsedCommand(client)
 		} else {
 			// cmd incompelete
 			// 命令不完整
@@ -339,66 +893,244 @@ func ProcessQueryBuf(client *GoRedisClient) error {
 
 func ReadQueryFromClient(loop *AeLoop, fd int, extra interface{}) {
 	client := extra.(*GoRedisClient)
-	// 装不下，进行扩容
-	// 这里减出来的空间用于放一条bulk命令，为了保证能够至少放得下，需要提前扩容
-	if len(client.queryBuf)-client.queryLen < MAX_BULK {
-		client.queryBuf = append(client.queryBuf, make([]byte, MAX_BULK)...)
+	// 同一批事件中客户端可能已经被释放
+	if client.flags&(CLIENT_CLOSED|CLIENT_CLOSE_ASAP) != 0 {
+		return
 	}
-	// queryLen前面还没有处理，不允许覆盖
-	n, err := Read(fd, client.queryBuf[client.queryLen:])
-	if err != nil {
-		log.Printf("client %v read err: %v\n", fd, err)
+	if client.tls != nil && client.tls.handshaking {
+		tlsHandshake(client)
+		// 握手完成之后in中可能已经有请求，继续往下读
+		if client.flags&CLIENT_CLOSED != 0 || client.tls.handshaking {
+			return
+		}
+	}
+	// 开启了io-threads时推迟到beforeSleep中由IO线程读取和解析
+	if postponeClientRead(client) {
 		return
 	}
-	defer func() {
-		if err != nil {
-			freeClient(client)
+	n, readLen, err := readQueryFromConn(client)
+	if !handleReadResult(client, n, readLen, err) {
+		return
+	}
+	if err = ProcessQueryBuf(client); err != nil {
+		setProtocolError(client, err)
+	}
+}
+
+// readQueryFromConn 从连接读一次数据追加到queryBuf，只修改这个客户端的状态，可以在IO线程中执行
+func readQueryFromConn(client *GoRedisClient) (n int, readLen int, err error) {
+	readLen = IO_BUF
+	// 正在读大参数时只读到参数结尾，这样参数可以直接使用整个缓冲区
+	if client.cmdTy == COMMAND_BULK && client.bulkLen >= PROTO_MBULK_BIG_ARG {
+		if remaining := client.bulkLen + 2 - (client.queryLen - client.qbPos); remaining > 0 {
+			readLen = remaining
 		}
-	}()
+	}
+	client.makeRoomForQuery(readLen)
+	// queryLen前面还没有处理，不允许覆盖
+	n, err = connRead(client, client.queryBuf[client.queryLen:client.queryLen+readLen])
+	if err != nil || n == 0 {
+		return n, readLen, err
+	}
 	// 增加未处理命令的长度
 	client.queryLen += n
+	client.lastInteraction = time.Now().Unix()
+	return n, readLen, nil
+}
+
+// handleReadResult 在主goroutine中处理读的结果，返回false表示没有新数据或者客户端已经被关闭
+func handleReadResult(client *GoRedisClient, n int, readLen int, err error) bool {
+	if err == unix.EAGAIN {
+		return false
+	}
+	if err != nil {
+		log.Printf("client %v read err: %v\n", client.fd, err)
+		freeClient(client)
+		return false
+	}
+	// 读到0字节说明对端已经关闭连接
+	if n == 0 {
+		log.Printf("client %v closed connection\n", client.fd)
+		freeClient(client)
+		return false
+	}
+	// 读满说明crypto/tls中可能还有数据，epoll不会再通知
+	if client.tls != nil && n == readLen && client.flags&CLIENT_TLS_PENDING == 0 {
+		client.flags |= CLIENT_TLS_PENDING
+		server.tlsPendingClients = append(server.tlsPendingClients, client)
+	}
+	server.stat.netInputBytes += int64(n)
 	log.Printf("read %v bytes from client:%v\n", n, client.fd)
-	log.Printf("ReadQueryFromClient, queryBuf : %v\n", string(client.queryBuf))
-	if err = ProcessQueryBuf(client); err != nil {
-		log.Printf("process query buf err: %v\n", err)
-		return
+	if queryBufLimitReached(client) {
+		pending := client.pendingQuery()
+		if len(pending) > 64 {
+			pending = pending[:64]
+		}
+		log.Printf("Closing client that reached max query buffer length: %v (qbuf initial bytes: %q)\n",
+			catClientInfoString(client), pending)
+		server.stat.queryBufLimitDisconnections++
+		freeClientAsync(client)
+		return false
 	}
+	return true
 }
 
-func SendReplyToClient(loop *AeLoop, fd int, extra interface{}) {
-	client := extra.(*GoRedisClient)
-	log.Printf("SendReplyToClient, reply len:%v\n", client.reply.Length())
-	for client.reply.Length() > 0 {
-		// 取第一个元素
-		rep := client.reply.First()
-		buf := []byte(rep.Val.Val_.(string))
-		bufLen := len(buf)
-		if client.sentLen < bufLen {
-			n, err := Write(fd, buf[client.sentLen:])
-			if err != nil {
-				log.Printf("send reply err: %v\n", err)
-				freeClient(client)
-				return
-			}
-			client.sentLen += n
-			log.Printf("send %v bytes to client:%v\n", n, client.fd)
-			// 完全发送完
-			if client.sentLen == bufLen {
-				client.reply.DelNode(rep)
-				// go 本身有gc是不用实现refcount的，这里是为了复现redis
-				rep.Val.DecrRefCount()
-				client.sentLen = 0
-			} else {
-				// 注意，write了不一定全部发送，真正n才是有效发送的，
-				// 不等于说明fd的缓冲区满了
+// queryBufLimitReached 还没有处理的请求超过了client-query-buffer-limit
+func queryBufLimitReached(client *GoRedisClient) bool {
+	return int64(client.queryLen-client.qbPos) > server.config.clientQueryBufLimit()
+}
+
+// setProtocolError 回复协议错误，回复发送完之后关闭连接，剩下的请求不再处理
+func setProtocolError(client *GoRedisClient, err error) {
+	log.Printf("protocol error from client %v: %v\n", client.addr, err)
+	client.AddReplyErrorFormat("Protocol error: %v", err)
+	closeClientAfterReply(client)
+	client.qbPos = 0
+	client.queryLen = 0
+}
+
+// connRead 普通连接直接读fd，TLS连接读出解密之后的数据
+func connRead(client *GoRedisClient, buf []byte) (int, error) {
+	if client.tls != nil {
+		return client.tls.Read(buf)
+	}
+	return Read(client.fd, buf)
+}
+
+// connWritev 普通连接直接写fd，TLS连接加密之后再写
+func connWritev(client *GoRedisClient, bufs [][]byte) (int, error) {
+	if client.tls != nil {
+		return client.tls.Writev(bufs)
+	}
+	return Writev(client.fd, bufs)
+}
+
+// writeToClient 用writev把buf和reply中的块尽量在一次系统调用中写出去，
+// handlerInstalled表示是否是在AE_WRITABLE回调中调用，写完之后需要注销事件
+func writeToClient(client *GoRedisClient, handlerInstalled bool) error {
+	total, err := writeToConn(client)
+	return handleWriteResult(client, total, err, handlerInstalled)
+}
+
+// writeToConn 只修改这个客户端的回复链表，可以在IO线程中执行，返回写出的字节数
+func writeToConn(client *GoRedisClient) (int, error) {
+	var iov [NET_IOV_MAX][]byte
+	total := 0
+	for client.hasPendingReplies() {
+		vecs := iov[:0]
+		offset := client.sentLen
+		if len(client.buf) > 0 {
+			vecs = append(vecs, client.buf[offset:])
+			offset = 0
+		}
+		for _, blk := range client.reply {
+			if len(vecs) == NET_IOV_MAX {
 				break
 			}
+			if len(blk.buf) > offset {
+				vecs = append(vecs, blk.buf[offset:])
+			}
+			offset = 0
+		}
+		n, err := connWritev(client, vecs)
+		if err == unix.EAGAIN {
+			// socket发送缓冲区满了，等待下一次可写
+			break
+		}
+		if err != nil {
+			return total, err
+		}
+		client.consumeReply(n)
+		total += n
+		// 一次最多写NET_MAX_WRITES_PER_EVENT字节，避免一个大回复占住整个事件循环
+		if total >= NET_MAX_WRITES_PER_EVENT {
+			break
 		}
 	}
-	if client.reply.Length() == 0 {
+	return total, nil
+}
+
+// handleWriteResult 在主goroutine中更新统计，写完之后注销可写事件或者关闭连接
+func handleWriteResult(client *GoRedisClient, total int, err error, handlerInstalled bool) error {
+	if err != nil {
+		log.Printf("send reply err: %v\n", err)
+		freeClient(client)
+		return err
+	}
+	server.stat.netOutputBytes += int64(total)
+	if total > 0 {
+		client.lastInteraction = time.Now().Unix()
+	}
+	if !client.hasPendingReplies() {
 		client.sentLen = 0
-		loop.RemoveFileEvent(fd, AE_WRITABLE)
+		if handlerInstalled {
+			server.aeLoop.RemoveFileEvent(client.fd, AE_WRITABLE)
+		}
+		if client.flags&CLIENT_CLOSE_AFTER_REPLY != 0 {
+			freeClient(client)
+		}
+	}
+	return nil
+}
+
+func SendReplyToClient(loop *AeLoop, fd int, extra interface{}) {
+	client := extra.(*GoRedisClient)
+	if client.flags&CLIENT_CLOSED != 0 {
+		return
 	}
+	_ = writeToClient(client, true)
+}
+
+// handleClientsWithPendingWrites 在进入epoll等待之前直接把回复写出去，
+// 大部分情况下一次就能写完，不需要再注册AE_WRITABLE事件
+func handleClientsWithPendingWrites() int {
+	pending := server.clientsPendingWrite
+	server.clientsPendingWrite = nil
+	clients := pending[:0]
+	var tlsClients []*GoRedisClient
+	for _, c := range pending {
+		c.flags &= ^CLIENT_PENDING_WRITE
+		if c.flags&CLIENT_CLOSED != 0 {
+			continue
+		}
+		// 和读一样，crypto/tls的状态只在主goroutine中访问，TLS连接不交给IO线程
+		if c.tls != nil {
+			tlsClients = append(tlsClients, c)
+		} else {
+			clients = append(clients, c)
+		}
+	}
+	// 客户端足够多时由IO线程并行写，统计和事件的注册仍然在主goroutine中
+	results := runIOThreads(IO_THREADS_OP_WRITE, clients)
+	for _, c := range tlsClients {
+		n, err := writeToConn(c)
+		clients = append(clients, c)
+		results = append(results, ioResult{n: n, err: err})
+	}
+	for i, c := range clients {
+		if handleWriteResult(c, results[i].n, results[i].err, false) != nil {
+			continue
+		}
+		// 没有写完的部分交给可写事件
+		if c.flags&CLIENT_CLOSED == 0 && c.hasPendingReplies() {
+			server.aeLoop.AddFileEvent(c.fd, AE_WRITABLE, SendReplyToClient, c)
+		}
+	}
+	return len(pending)
+}
+
+// beforeSleep 每次进入epoll等待之前调用
+func beforeSleep(loop *AeLoop) {
+	handleClientsWithPendingReadsUsingThreads()
+	checkClientPauseTimeout()
+	processUnblockedClients()
+	processTlsPendingData()
+	// ServerCron中的清理没有在时间限制内完成时，在这里用很短的时间继续清理
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_FAST)
+	handleClientsWithPendingWrites()
+	checkShutdownProgress()
+	// 超过输出缓冲区限制等原因被异步关闭的客户端尽快释放
+	freeClientsInAsyncFreeQueue()
 }
 
 func GStrEqual(a, b *GObj) bool {
@@ -420,83 +1152,358 @@ func GStrHash(key *GObj) int64 {
 }
 
 func CreateClient(fd int) *GoRedisClient {
+	server.nextClientId++
 	return &GoRedisClient{
-		fd:       fd,
-		db:       server.db,
-		queryBuf: make([]byte, IO_BUF),
-		reply:    ListCreate(ListType{EqualFunc: GStrEqual}),
+		id:              server.nextClientId,
+		fd:              fd,
+		resp:            RESP2,
+		user:            acl.defaultUser,
+		db:              server.db,
+		queryBuf:        make([]byte, IO_BUF),
+		bulkLen:         -1,
+		buf:             make([]byte, 0, PROTO_REPLY_CHUNK_BYTES),
+		ctime:           time.Now().Unix(),
+		lastInteraction: time.Now().Unix(),
+	}
+}
+
+const protectedModeErr = "-DENIED Redis is running in protected mode because protected mode is enabled, " +
+	"no bind address was specified, no authentication password is requested to clients. " +
+	"In this mode connections are only accepted from the loopback interface. " +
+	"If you want to connect from external computers to Redis you may adopt one of the following solutions: " +
+	"1) Disable the protected mode by editing the configuration file, and setting the protected mode option to 'no', " +
+	"and then restarting the server. " +
+	"2) If you started the server manually just for testing, restart it with the '--protected-mode no' option. " +
+	"3) Setup a bind address or an authentication password. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside.\r\n"
+
+// protectedModeDenied 保护模式下，没有配置bind和default用户的密码时拒绝非本机的连接
+func protectedModeDenied(fd int, addr string) bool {
+	if !server.config.ProtectedMode || len(server.config.Bind) > 0 || fd == server.sofd {
+		return false
+	}
+	if acl.defaultUser == nil || !acl.defaultUser.nopass {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
 }
 
 func AcceptHandler(_ *AeLoop, fd int, extra interface{}) {
-	cfd, err := Accept(fd)
+	cfd, addr, err := Accept(fd)
 	if err != nil {
 		log.Printf("accept err: %v\n", err)
 		return
 	}
+	// 超过最大连接数时直接写一个错误，不需要经过回复缓冲区
+	if len(server.clients) >= server.maxclients {
+		_, _ = Write(cfd, []byte("-ERR max number of clients reached\r\n"))
+		Close(cfd)
+		server.stat.rejectedConns++
+		return
+	}
+	if protectedModeDenied(fd, addr) {
+		_, _ = Write(cfd, []byte(protectedModeErr))
+		Close(cfd)
+		server.stat.rejectedConns++
+		return
+	}
 	client := CreateClient(cfd)
-	// TODO: check max clients limit
-	server.clients[cfd] = client
+	if fd == server.sofd {
+		// unix socket的对端没有地址，和redis一样在CLIENT LIST中显示为 /path:0，MONITOR中显示为 unix:path
+		client.flags |= CLIENT_UNIX_SOCKET
+		path := server.config.Unixsocket
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		client.addr = path + ":0"
+		client.laddr = client.addr
+	} else {
+		client.addr = addr
+		client.laddr = LocalAddr(cfd)
+	}
+	linkClient(client)
+	server.stat.numConnections++
 	server.aeLoop.AddFileEvent(cfd, AE_READABLE, ReadQueryFromClient, client)
 	log.Printf("accept client, fd: %v\n", cfd)
+	// tls-port上的连接先握手，extra是监听时传入的tls配置
+	if tlsConfig, ok := extra.(*tls.Config); ok && tlsConfig != nil {
+		client.tls = newTlsConn(cfd, tlsConfig)
+		if _, err := client.tls.startHandshake(); err != nil {
+			log.Printf("tls handshake with client %v failed: %v\n", client.addr, err)
+			freeClient(client)
+		}
+	}
 }
 
-const EXPIRE_CHECK_COUNT int = 100
+const (
+	CRON_INTERVAL               int64 = 100 // ms，ServerCron执行间隔
+	CLIENTS_CRON_MIN_ITERATIONS int   = 5   // clientsCron每次至少检查的客户端个数
+	CONFIG_MIN_RESERVED_FDS     int   = 32  // 除了客户端之外给监听、日志等保留的fd
+)
 
-func ServerCron(_ *AeLoop, id int, extra interface{}) {
-	// 随机检查100个在expire字典的key
-	for i := 0; i < EXPIRE_CHECK_COUNT; i++ {
-		entry := server.db.expire.RandomGet()
-		if entry == nil {
+// clientsCronHandleTimeout 关闭空闲超时的客户端，返回客户端是否已经被释放
+func clientsCronHandleTimeout(c *GoRedisClient, now int64) bool {
+	timeout := int64(server.config.Timeout)
+	if timeout <= 0 || c.flags&(CLIENT_MONITOR|CLIENT_REPLICA|CLIENT_MASTER|CLIENT_PUBSUB) != 0 {
+		return false
+	}
+	if now-c.lastInteraction <= timeout {
+		return false
+	}
+	log.Printf("Closing idle client %v\n", catClientInfoString(c))
+	freeClient(c)
+	return true
+}
+
+// clientsCron 每次只检查一部分客户端，所有客户端大约每秒轮一遍，客户端很多时也不会卡住事件循环
+func clientsCron() {
+	iterations := len(server.clientList) * int(CRON_INTERVAL) / 1000
+	if iterations < CLIENTS_CRON_MIN_ITERATIONS {
+		iterations = CLIENTS_CRON_MIN_ITERATIONS
+	}
+	if iterations > len(server.clientList) {
+		iterations = len(server.clientList)
+	}
+	now := time.Now().Unix()
+	for ; iterations > 0 && len(server.clientList) > 0; iterations-- {
+		if server.clientsCronPos >= len(server.clientList) {
+			server.clientsCronPos = 0
+		}
+		c := server.clientList[server.clientsCronPos]
+		// 被释放时后面的客户端会移到当前位置，不需要前进
+		if clientsCronHandleTimeout(c, now) {
+			continue
+		}
+		server.clientsCronPos++
+	}
+}
+
+// adjustOpenFilesLimit 每个客户端占用一个fd，尽量把RLIMIT_NOFILE调到maxclients加上保留的fd，
+// 调不上去时按照实际能拿到的上限减少maxclients。它修改的是整个进程的限制，只在main中调用
+func adjustOpenFilesLimit() error {
+	maxfiles := uint64(server.maxclients + CONFIG_MIN_RESERVED_FDS)
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &limit); err != nil {
+		log.Printf("Unable to obtain the current NOFILE limit (%v), assuming 1024 and setting the max clients configuration accordingly.\n", err)
+		server.maxclients = 1024 - CONFIG_MIN_RESERVED_FDS
+		return nil
+	}
+	if limit.Cur >= maxfiles {
+		return nil
+	}
+	// 一次设置不成功就每次减少16重试，直到不比当前的限制大
+	best := maxfiles
+	for best > limit.Cur {
+		rl := unix.Rlimit{Cur: best, Max: limit.Max}
+		if best > rl.Max {
+			rl.Max = best
+		}
+		if unix.Setrlimit(unix.RLIMIT_NOFILE, &rl) == nil {
 			break
 		}
-		// expire dict 的 val 是时间戳
-		if entry.Val.IntVal() < time.Now().Unix() {
-			_ = server.db.data.Delete(entry.Key)
-			_ = server.db.expire.Delete(entry.Key)
+		if best < 16 {
+			best = limit.Cur
+			break
+		}
+		best -= 16
+	}
+	if best < limit.Cur {
+		best = limit.Cur
+	}
+	if best < maxfiles {
+		if best <= uint64(CONFIG_MIN_RESERVED_FDS) {
+			return fmt.Errorf("your current 'ulimit -n' of %d is not enough for the server to start, please increase your open file limit to at least %d",
+				limit.Cur, maxfiles)
+		}
+		log.Printf("You requested maxclients of %d requiring at least %d max file descriptors.\n", server.maxclients, maxfiles)
+		server.maxclients = int(best) - CONFIG_MIN_RESERVED_FDS
+		log.Printf("Server can't set maximum open files to %d, maxclients has been reduced to %d.\n", maxfiles, server.maxclients)
+	} else {
+		log.Printf("Increased maximum number of open files to %d (it was originally set to %d).\n", maxfiles, limit.Cur)
+	}
+	return nil
+}
+
+func ServerCron(_ *AeLoop, id int, extra interface{}) {
+	// 收到SIGTERM/SIGINT之后在这里开始关闭
+	if server.shutdownAsap.Load() != 0 && !isShutdownInitiated() {
+		if err := prepareForShutdown(SHUTDOWN_NOFLAGS); err != nil {
+			log.Printf("SIGTERM received but errors trying to shut down the server, check the logs for more information\n")
+			server.shutdownAsap.Store(0)
 		}
 	}
+	freeClientsInAsyncFreeQueue()
+	clientsCron()
+	trackInstantaneousOps()
+	checkClientPauseTimeout()
+	activeExpireCycle(ACTIVE_EXPIRE_CYCLE_SLOW)
 }
 
 // initServer 初始化server
 func initServer(config *Config) error {
+	server.config = config
 	server.port = config.Port
+	server.runId = genRunId()
+	server.startTime = time.Now()
+	server.stat = serverStats{}
+	populateCommandTable()
+	slowlogInit(config.SlowlogMaxLen)
+	if err := aclInit(config); err != nil {
+		return err
+	}
 	server.clients = make(map[int]*GoRedisClient)
+	server.clientList = nil
+	server.clientsCronPos = 0
+	server.maxclients = config.maxClients()
+	server.monitors = nil
+	server.clientsToClose = nil
+	server.clientsPendingWrite = nil
+	server.clientPauseType = CLIENT_PAUSE_OFF
+	server.clientPauseEndTime = 0
+	server.clientPauses = [NUM_PAUSE_PURPOSES]clientPause{}
+	server.pausedClients = nil
+	server.unblockedClients = nil
+	server.shutdownAsap.Store(0)
+	server.shutdownFlags = 0
+	server.shutdownMstime = 0
+	server.shutdownClients = nil
+	server.expireTimelimitExit = false
+	server.expireLastFastCycle = time.Time{}
 	// 创建两个大字典，redis本身也是个大dict
 	server.db = &GoRedisDB{
 		data:   DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
 		expire: DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
 	}
-	var err error
 	// 创建ae事件
-	if server.aeLoop, err = AeLoopCreate(); err != nil {
+	poller, err := NewPoller(config.Poller)
+	if err != nil {
 		return err
 	}
-	if server.fd, err = TcpServer(server.port); err != nil {
+	server.aeLoop = AeLoopCreateWithPoller(poller)
+	initThreadedIO()
+	server.sofd = -1
+	server.ipfd, server.tlsfd = nil, nil
+	server.tlsPendingClients = nil
+	if server.tlsConfig, err = tlsConfigure(config); err != nil {
+		return err
+	}
+	return openListeningSockets()
+}
+
+// openListeningSockets 创建所有的监听fd并注册AcceptHandler，SHUTDOWN ABORT 时也用它重新监听
+func openListeningSockets() error {
+	var err error
+	config := server.config
+	if server.ipfd, err = listenToPort(server.port); err != nil {
 		return err
 	}
+	if config.TlsPort != 0 {
+		if server.tlsfd, err = listenToPort(config.TlsPort); err != nil {
+			closeListeningSockets()
+			return err
+		}
+	}
+	if config.Unixsocket != "" {
+		if server.sofd, err = UnixServer(config.Unixsocket, config.Unixsocketperm); err != nil {
+			closeListeningSockets()
+			return err
+		}
+	}
+	if len(server.ipfd) == 0 && len(server.tlsfd) == 0 && server.sofd == -1 {
+		return errors.New("configured to not listen anywhere")
+	}
+	// 监听fd的readable事件由AcceptHandler处理，tls-port上的连接通过extra带上tls配置
+	for _, fd := range server.ipfd {
+		server.aeLoop.AddFileEvent(fd, AE_READABLE, AcceptHandler, nil)
+	}
+	for _, fd := range server.tlsfd {
+		server.aeLoop.AddFileEvent(fd, AE_READABLE, AcceptHandler, server.tlsConfig)
+	}
+	if server.sofd != -1 {
+		server.aeLoop.AddFileEvent(server.sofd, AE_READABLE, AcceptHandler, nil)
+		log.Printf("listening on unix socket %v\n", config.Unixsocket)
+	}
 	return nil
 }
 
-func main() {
-	// 入参是配置文件地址
-	path := ""
-	if len(os.Args) > 1 {
-		path = os.Args[1]
+// listenToPort 为bind中的每个地址创建一个监听port的fd，系统不支持的协议以及不存在的可选地址会被跳过
+func listenToPort(port int) ([]int, error) {
+	var fds []int
+	for _, addr := range server.config.bindAddrs() {
+		host := addr
+		optional := strings.HasPrefix(host, "-")
+		if optional {
+			host = host[1:]
+		}
+		fd, err := TcpServer(host, port)
+		if err != nil {
+			log.Printf("could not create server TCP listening socket %v:%v: %v\n", host, port, err)
+			if optional && errors.Is(err, unix.EADDRNOTAVAIL) {
+				continue
+			}
+			if errors.Is(err, unix.ENOPROTOOPT) || errors.Is(err, unix.EPROTONOSUPPORT) ||
+				errors.Is(err, unix.ESOCKTNOSUPPORT) || errors.Is(err, unix.EPFNOSUPPORT) ||
+				errors.Is(err, unix.EAFNOSUPPORT) {
+				continue
+			}
+			for _, fd := range fds {
+				Close(fd)
+			}
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// closeListeningSockets 关闭监听的fd，并删除unix socket文件
+func closeListeningSockets() {
+	for _, fd := range append(server.ipfd, server.tlsfd...) {
+		server.aeLoop.RemoveFileEvent(fd, AE_READABLE)
+		Close(fd)
 	}
+	server.ipfd, server.tlsfd = nil, nil
+	if server.sofd != -1 {
+		server.aeLoop.RemoveFileEvent(server.sofd, AE_READABLE)
+		Close(server.sofd)
+		server.sofd = -1
+		if err := os.Remove(server.config.Unixsocket); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove unix socket err: %v\n", err)
+		}
+	}
+}
+
+func main() {
+	// 入参是配置文件地址，后面可以跟 --port 7000 形式的覆盖项
+	path, overrides := ParseArgs(os.Args[1:])
 	// 加载配置文件
-	config, err := LoadConfig(path)
+	config, err := LoadConfig(path, overrides)
 	if err != nil {
 		log.Printf("config error: %v\n", err)
+		os.Exit(1)
 	}
+	server.configFile = path
 	if err = initServer(config); err != nil {
 		log.Printf("init server error: %v\n", err)
-		return
+		os.Exit(1)
+	}
+	// 还没有接受连接，减少maxclients不影响已有的客户端
+	if err = adjustOpenFilesLimit(); err != nil {
+		log.Printf("init server error: %v\n", err)
+		os.Exit(1)
+	}
+	if err = createPidFile(); err != nil {
+		log.Printf("failed to write pid file: %v\n", err)
 	}
-	// 为server fd添加readable事件,该事件由AcceptHandler处理
-	server.aeLoop.AddFileEvent(server.fd, AE_READABLE, AcceptHandler, nil)
+	setupSignalHandlers()
+	server.aeLoop.AddBeforeSleepProc(beforeSleep)
 	// 启动清除expire key 的事件
-	server.aeLoop.AddTimeEvent(AE_NORMAL, 100, ServerCron, nil)
+	server.aeLoop.AddTimeEvent(AE_NORMAL, CRON_INTERVAL, ServerCron, nil)
 	log.Println("go-redis server is up.")
 	log.Println(`     
 	____   ____           _______   ____   __| _/|__| ______
@@ -505,5 +1512,6 @@ func main() {
   \___  / \____/           |__|    \___  >____ | |__/____  >
  /_____/                               \/     \/         \/ 
  `)
+	// 只有SHUTDOWN成功之后事件循环才会退出
 	server.aeLoop.AeMain()
 }
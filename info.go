@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// REDIS_VERSION 兼容的redis版本，客户端会根据它判断支持哪些特性
+const REDIS_VERSION string = "7.0.0"
+
+const STATS_METRIC_SAMPLES int = 16 // ops/sec 采样个数
+
+type serverStats struct {
+	numConnections              int64   // 累计接受的连接数
+	rejectedConns               int64   // 超过maxclients被拒绝的连接数
+	numCommands                 int64   // 累计执行的命令数
+	expiredKeys                 int64   // 过期删除的key数量
+	expiredStalePerc            float64 // activeExpireCycle采样中已过期key的比例，滑动平均
+	expiredTimeCapReachedCount  int64   // activeExpireCycle因为超时退出的次数
+	ioThreadedReadsProcessed    int64   // 由IO线程读取的客户端次数
+	ioThreadedWritesProcessed   int64   // 由IO线程写回复的客户端次数
+	keyspaceHits                int64
+	keyspaceMisses              int64
+	netInputBytes               int64
+	netOutputBytes              int64
+	errorReplies                int64 // 回复给客户端的错误数量
+	obufLimitDisconnections     int64 // 超过输出缓冲区限制被断开的客户端数量
+	queryBufLimitDisconnections int64 // 超过请求缓冲区限制被断开的客户端数量
+	opsSamples                  [STATS_METRIC_SAMPLES]int64
+	opsSampleIdx                int
+	lastSampleTime              int64 // ms
+	lastSampleCount             int64
+}
+
+// trackInstantaneousOps 在ServerCron中采样，记录两次采样之间的每秒命令数
+func trackInstantaneousOps() {
+	now := GetMsTime()
+	st := &server.stat
+	if st.lastSampleTime > 0 && now > st.lastSampleTime {
+		ops := (st.numCommands - st.lastSampleCount) * 1000 / (now - st.lastSampleTime)
+		st.opsSamples[st.opsSampleIdx] = ops
+		st.opsSampleIdx = (st.opsSampleIdx + 1) % STATS_METRIC_SAMPLES
+	}
+	st.lastSampleTime = now
+	st.lastSampleCount = st.numCommands
+}
+
+// instantaneousOps 取采样的平均值
+func instantaneousOps() int64 {
+	var sum int64
+	for _, v := range server.stat.opsSamples {
+		sum += v
+	}
+	return sum / int64(STATS_METRIC_SAMPLES)
+}
+
+func genRunId() string {
+	buf := make([]byte, 20)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// bytesToHuman 把字节数转换成可读的格式，例如 1.00M
+func bytesToHuman(n uint64) string {
+	d := float64(n)
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.2fK", d/1024)
+	case n < 1024*1024*1024:
+		return fmt.Sprintf("%.2fM", d/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fG", d/(1024*1024*1024))
+	}
+}
+
+func infoServer(b *strings.Builder) {
+	uptime := int64(time.Since(server.startTime).Seconds())
+	exe, _ := os.Executable()
+	b.WriteString("# Server\r\n")
+	fmt.Fprintf(b, "redis_version:%s\r\n", REDIS_VERSION)
+	fmt.Fprintf(b, "redis_mode:standalone\r\n")
+	fmt.Fprintf(b, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(b, "multiplexing_api:%s\r\n", server.aeLoop.poller.Name())
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "run_id:%s\r\n", server.runId)
+	fmt.Fprintf(b, "tcp_port:%d\r\n", server.port)
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", uptime)
+	fmt.Fprintf(b, "uptime_in_days:%d\r\n", uptime/(3600*24))
+	fmt.Fprintf(b, "hz:%d\r\n", 1000/CRON_INTERVAL)
+	fmt.Fprintf(b, "executable:%s\r\n", exe)
+	fmt.Fprintf(b, "config_file:%s\r\n", server.configFile)
+}
+
+func infoClients(b *strings.Builder) {
+	b.WriteString("# Clients\r\n")
+	fmt.Fprintf(b, "connected_clients:%d\r\n", len(server.clients))
+	fmt.Fprintf(b, "maxclients:%d\r\n", server.maxclients)
+}
+
+func infoMemory(b *strings.Builder) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	var maxmemory int64
+	if server.config != nil {
+		maxmemory = server.config.Maxmemory
+	}
+	rehashing := 0
+	for _, d := range []*Dict{server.db.data, server.db.expire} {
+		if d.isRehashing() {
+			rehashing++
+		}
+	}
+	b.WriteString("# Memory\r\n")
+	fmt.Fprintf(b, "used_memory:%d\r\n", ms.HeapAlloc)
+	fmt.Fprintf(b, "used_memory_human:%s\r\n", bytesToHuman(ms.HeapAlloc))
+	fmt.Fprintf(b, "used_memory_rss:%d\r\n", ms.Sys)
+	fmt.Fprintf(b, "used_memory_rss_human:%s\r\n", bytesToHuman(ms.Sys))
+	fmt.Fprintf(b, "maxmemory:%d\r\n", maxmemory)
+	fmt.Fprintf(b, "maxmemory_human:%s\r\n", bytesToHuman(uint64(maxmemory)))
+	fmt.Fprintf(b, "go_heap_objects:%d\r\n", ms.HeapObjects)
+	fmt.Fprintf(b, "go_heap_inuse:%d\r\n", ms.HeapInuse)
+	fmt.Fprintf(b, "go_heap_idle:%d\r\n", ms.HeapIdle)
+	fmt.Fprintf(b, "go_num_gc:%d\r\n", ms.NumGC)
+	fmt.Fprintf(b, "go_gc_pause_total_ns:%d\r\n", ms.PauseTotalNs)
+	fmt.Fprintf(b, "go_goroutines:%d\r\n", runtime.NumGoroutine())
+	fmt.Fprintf(b, "rehashing_dicts:%d\r\n", rehashing)
+}
+
+func infoPersistence(b *strings.Builder) {
+	// 还没有实现持久化
+	b.WriteString("# Persistence\r\n")
+	b.WriteString("loading:0\r\n")
+	b.WriteString("rdb_bgsave_in_progress:0\r\n")
+	b.WriteString("aof_enabled:0\r\n")
+	b.WriteString("aof_rewrite_in_progress:0\r\n")
+}
+
+func infoStats(b *strings.Builder) {
+	st := &server.stat
+	b.WriteString("# Stats\r\n")
+	fmt.Fprintf(b, "total_connections_received:%d\r\n", st.numConnections)
+	fmt.Fprintf(b, "total_commands_processed:%d\r\n", st.numCommands)
+	fmt.Fprintf(b, "rejected_connections:%d\r\n", st.rejectedConns)
+	fmt.Fprintf(b, "instantaneous_ops_per_sec:%d\r\n", instantaneousOps())
+	fmt.Fprintf(b, "total_net_input_bytes:%d\r\n", st.netInputBytes)
+	fmt.Fprintf(b, "total_net_output_bytes:%d\r\n", st.netOutputBytes)
+	fmt.Fprintf(b, "total_error_replies:%d\r\n", st.errorReplies)
+	fmt.Fprintf(b, "client_query_buffer_limit_disconnections:%d\r\n", st.queryBufLimitDisconnections)
+	fmt.Fprintf(b, "client_output_buffer_limit_disconnections:%d\r\n", st.obufLimitDisconnections)
+	fmt.Fprintf(b, "expired_keys:%d\r\n", st.expiredKeys)
+	fmt.Fprintf(b, "expired_stale_perc:%.2f\r\n", st.expiredStalePerc)
+	fmt.Fprintf(b, "expired_time_cap_reached_count:%d\r\n", st.expiredTimeCapReachedCount)
+	fmt.Fprintf(b, "keyspace_hits:%d\r\n", st.keyspaceHits)
+	fmt.Fprintf(b, "keyspace_misses:%d\r\n", st.keyspaceMisses)
+	fmt.Fprintf(b, "io_threaded_reads_processed:%d\r\n", st.ioThreadedReadsProcessed)
+	fmt.Fprintf(b, "io_threaded_writes_processed:%d\r\n", st.ioThreadedWritesProcessed)
+}
+
+func infoReplication(b *strings.Builder) {
+	b.WriteString("# Replication\r\n")
+	b.WriteString("role:master\r\n")
+	b.WriteString("connected_slaves:0\r\n")
+}
+
+func infoCpu(b *strings.Builder) {
+	var ru unix.Rusage
+	_ = unix.Getrusage(unix.RUSAGE_SELF, &ru)
+	b.WriteString("# CPU\r\n")
+	fmt.Fprintf(b, "used_cpu_sys:%d.%06d\r\n", ru.Stime.Sec, ru.Stime.Usec)
+	fmt.Fprintf(b, "used_cpu_user:%d.%06d\r\n", ru.Utime.Sec, ru.Utime.Usec)
+}
+
+func infoCommandStats(b *strings.Builder) {
+	b.WriteString("# Commandstats\r\n")
+	var cmds []*GoRedisCommand
+	for _, cmd := range sortedCommands() {
+		cmds = append(cmds, cmd)
+		for i := range cmd.subcommands {
+			cmds = append(cmds, &cmd.subcommands[i])
+		}
+	}
+	for _, c := range cmds {
+		if c.calls == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n",
+			c.fullName(), c.calls, c.microseconds, float64(c.microseconds)/float64(c.calls))
+	}
+}
+
+func infoKeyspace(b *strings.Builder) {
+	b.WriteString("# Keyspace\r\n")
+	keys := server.db.data.Len()
+	if keys > 0 {
+		fmt.Fprintf(b, "db0:keys=%d,expires=%d,avg_ttl=0\r\n", keys, server.db.expire.Len())
+	}
+}
+
+type infoSection struct {
+	name      string
+	gen       func(b *strings.Builder)
+	isDefault bool // 不带参数的INFO是否输出
+}
+
+var infoSections = []infoSection{
+	{"server", infoServer, true},
+	{"clients", infoClients, true},
+	{"memory", infoMemory, true},
+	{"persistence", infoPersistence, true},
+	{"stats", infoStats, true},
+	{"replication", infoReplication, true},
+	{"cpu", infoCpu, true},
+	{"commandstats", infoCommandStats, false},
+	{"keyspace", infoKeyspace, true},
+}
+
+// genInfoString 按照redis的格式生成INFO文本，sections为空时输出默认的部分
+func genInfoString(sections []string) string {
+	want := make(map[string]bool)
+	all, everything := false, false
+	for _, s := range sections {
+		s = strings.ToLower(s)
+		switch s {
+		case "all", "everything":
+			all = true
+			everything = true
+		case "default":
+			all = true
+		default:
+			want[s] = true
+		}
+	}
+	if len(sections) == 0 {
+		all = true
+	}
+	var b strings.Builder
+	for _, sec := range infoSections {
+		if !want[sec.name] && !(all && (sec.isDefault || everything)) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		sec.gen(&b)
+	}
+	return b.String()
+}
+
+func infoCommand(c *GoRedisClient) {
+	sections := make([]string, 0, len(c.args)-1)
+	for _, arg := range c.args[1:] {
+		sections = append(sections, arg.StrVal())
+	}
+	c.AddReplyVerbatim(genInfoString(sections), "txt")
+}
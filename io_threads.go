@@ -0,0 +1,162 @@
+package main
+
+import "sync"
+
+// IO_THREADS_MAX_NUM io-threads 的上限，和redis一致
+const IO_THREADS_MAX_NUM int = 128
+
+// IO线程执行的操作
+const (
+	IO_THREADS_OP_READ int = iota
+	IO_THREADS_OP_WRITE
+)
+
+// ioJob 一轮中分给一个IO线程的工作，第id个客户端开始每隔step个处理一个，
+// 结果写到results中对应的位置，主goroutine等所有线程完成之后再处理
+type ioJob struct {
+	op      int
+	id      int
+	step    int
+	clients []*GoRedisClient
+	results []ioResult
+	done    *sync.WaitGroup
+}
+
+// ioResult 读写的结果，IO线程中不修改任何全局状态，错误、统计和释放客户端都交给主goroutine
+type ioResult struct {
+	n        int
+	readLen  int
+	err      error
+	parsed   bool // 已经解析出一条完整的命令，等待主goroutine执行
+	parseErr error
+}
+
+// ioThread 常驻的worker goroutine，命令始终在主goroutine中执行，
+// 它只负责读socket、解析请求和写回复这些只涉及单个客户端的工作
+type ioThread struct {
+	jobs chan ioJob
+}
+
+func ioThreadMain(t *ioThread) {
+	for job := range t.jobs {
+		processIOJob(job)
+		job.done.Done()
+	}
+}
+
+// initThreadedIO 按照io-threads启动IO线程，第0个是主goroutine自己，重新初始化时先停掉原来的线程
+func initThreadedIO() {
+	for _, t := range server.ioThreads {
+		if t != nil {
+			close(t.jobs)
+		}
+	}
+	server.ioThreads = nil
+	server.clientsPendingRead = nil
+	n := server.config.ioThreads()
+	if n <= 1 {
+		return
+	}
+	server.ioThreads = make([]*ioThread, n)
+	for i := 1; i < n; i++ {
+		t := &ioThread{jobs: make(chan ioJob, 1)}
+		server.ioThreads[i] = t
+		go ioThreadMain(t)
+	}
+}
+
+// postponeClientRead 开启了io-threads时把客户端放到clientsPendingRead，在beforeSleep中统一读取，
+// TLS连接在crypto/tls中可能缓存了数据，需要在主goroutine中配合tlsPendingClients一起处理
+func postponeClientRead(c *GoRedisClient) bool {
+	if len(server.ioThreads) <= 1 || c.tls != nil || c.flags&(CLIENT_MASTER|CLIENT_REPLICA|CLIENT_BLOCKED) != 0 {
+		return false
+	}
+	if c.flags&CLIENT_PENDING_READ == 0 {
+		c.flags |= CLIENT_PENDING_READ
+		server.clientsPendingRead = append(server.clientsPendingRead, c)
+	}
+	return true
+}
+
+// runIOThreads 把客户端分给IO线程并等待完成，客户端比较少的时候分发的开销比收益大，主goroutine自己处理
+func runIOThreads(op int, clients []*GoRedisClient) []ioResult {
+	results := make([]ioResult, len(clients))
+	n := len(server.ioThreads)
+	if n <= 1 || len(clients) < n*2 {
+		processIOJob(ioJob{op: op, id: 0, step: 1, clients: clients, results: results})
+		return results
+	}
+	var done sync.WaitGroup
+	done.Add(n - 1)
+	for i := 1; i < n; i++ {
+		server.ioThreads[i].jobs <- ioJob{op: op, id: i, step: n, clients: clients, results: results, done: &done}
+	}
+	processIOJob(ioJob{op: op, id: 0, step: n, clients: clients, results: results})
+	done.Wait()
+	if op == IO_THREADS_OP_READ {
+		server.stat.ioThreadedReadsProcessed += int64(len(clients))
+	} else {
+		server.stat.ioThreadedWritesProcessed += int64(len(clients))
+	}
+	return results
+}
+
+func processIOJob(job ioJob) {
+	for i := job.id; i < len(job.clients); i += job.step {
+		c := job.clients[i]
+		res := &job.results[i]
+		if job.op == IO_THREADS_OP_WRITE {
+			res.n, res.err = writeToConn(c)
+			continue
+		}
+		res.n, res.readLen, res.err = readQueryFromConn(c)
+		// 只解析第一条命令，后面的命令在主goroutine中执行完这一条之后再解析
+		if res.err == nil && res.n > 0 && !queryBufLimitReached(c) && canProcessQuery(c) {
+			res.parsed, res.parseErr = parseCommand(c)
+		}
+	}
+}
+
+// handleClientsWithPendingReadsUsingThreads 在beforeSleep中读取被推迟的客户端，
+// 然后按照事件发生的顺序在主goroutine中执行命令
+func handleClientsWithPendingReadsUsingThreads() int {
+	pending := server.clientsPendingRead
+	server.clientsPendingRead = nil
+	clients := pending[:0]
+	for _, c := range pending {
+		c.flags &= ^CLIENT_PENDING_READ
+		// 推迟期间可能已经被关闭，fd可能已经被新的连接复用
+		if c.flags&(CLIENT_CLOSED|CLIENT_CLOSE_ASAP) == 0 {
+			clients = append(clients, c)
+		}
+	}
+	if len(clients) == 0 {
+		return 0
+	}
+	results := runIOThreads(IO_THREADS_OP_READ, clients)
+	for i, c := range clients {
+		res := &results[i]
+		// 前面的命令可能关闭了这个客户端，例如CLIENT KILL
+		if c.flags&CLIENT_CLOSED != 0 {
+			continue
+		}
+		if !handleReadResult(c, res.n, res.readLen, res.err) {
+			continue
+		}
+		if res.parseErr != nil {
+			setProtocolError(c, res.parseErr)
+			continue
+		}
+		// 前面的命令可能已经异步关闭了这个客户端，已经解析好的命令也不能再执行
+		if c.flags&(CLIENT_CLOSE_ASAP|CLIENT_CLOSE_AFTER_REPLY|CLIENT_BLOCKED) != 0 {
+			continue
+		}
+		if res.parsed {
+			processParsedCommand(c)
+		}
+		if err := ProcessQueryBuf(c); err != nil {
+			setProtocolError(c, err)
+		}
+	}
+	return len(clients)
+}
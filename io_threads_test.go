@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// newThreadedTestClient 和AcceptHandler一样注册可读事件，返回对端的fd
+func newThreadedTestClient(t *testing.T) (*GoRedisClient, int) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, unix.SetNonblock(fds[0], true))
+	t.Cleanup(func() { unix.Close(fds[1]) })
+	c := CreateClient(fds[0])
+	linkClient(c)
+	server.aeLoop.AddFileEvent(fds[0], AE_READABLE, ReadQueryFromClient, c)
+	return c, fds[1]
+}
+
+func TestIOThreads(t *testing.T) {
+	conf := Config{IoThreads: 4}
+	assert.Nil(t, initServer(&conf))
+	defer closeListeningSockets()
+	assert.Equal(t, 4, len(server.ioThreads))
+
+	clients := make([]*GoRedisClient, 16)
+	peers := make([]int, 16)
+	for i := range clients {
+		clients[i], peers[i] = newThreadedTestClient(t)
+		_, err := unix.Write(peers[i], []byte(fmt.Sprintf("set k%d v%d\r\nget k%d\r\n", i, i, i)))
+		assert.Nil(t, err)
+	}
+	bad, badPeer := newThreadedTestClient(t)
+	_, err := unix.Write(badPeer, []byte("*1\r\n$x\r\nget k0\r\n"))
+	assert.Nil(t, err)
+	killed, killedPeer := newThreadedTestClient(t)
+	_, err = unix.Write(killedPeer, []byte("get k0\r\n"))
+	assert.Nil(t, err)
+
+	// 可读事件只是把客户端放到clientsPendingRead
+	server.aeLoop.AeProcess(server.aeLoop.AeWait())
+	assert.Equal(t, 18, len(server.clientsPendingRead))
+	assert.NotZero(t, clients[0].flags&CLIENT_PENDING_READ)
+	assert.Equal(t, 0, clients[0].queryLen)
+	// 推迟期间被关闭的客户端不再读取
+	freeClient(killed)
+
+	// beforeSleep中由IO线程读取、解析和写回复，命令在主goroutine中按顺序执行
+	beforeSleep(server.aeLoop)
+	assert.Equal(t, 0, len(server.clientsPendingRead))
+	assert.Zero(t, clients[0].flags&CLIENT_PENDING_READ)
+	assert.Equal(t, int64(17), server.stat.ioThreadedReadsProcessed)
+	assert.Equal(t, int64(17), server.stat.ioThreadedWritesProcessed)
+	buf := make([]byte, 128)
+	for i, peer := range peers {
+		n, err := unix.Read(peer, buf)
+		assert.Nil(t, err)
+		v := fmt.Sprintf("v%d", i)
+		assert.Equal(t, fmt.Sprintf("+OK\r\n$%d\r\n%s\r\n", len(v), v), string(buf[:n]))
+	}
+	n, err := unix.Read(badPeer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length\r\n", string(buf[:n]))
+	assert.NotZero(t, bad.flags&CLIENT_CLOSED)
+	assert.Contains(t, genInfoString([]string{"stats"}), "io_threaded_reads_processed:17\r\n")
+
+	// 客户端比较少时主goroutine自己处理
+	_, err = unix.Write(peers[0], []byte("get k1\r\n"))
+	assert.Nil(t, err)
+	server.aeLoop.AeProcess(server.aeLoop.AeWait())
+	beforeSleep(server.aeLoop)
+	n, err = unix.Read(peers[0], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$2\r\nv1\r\n", string(buf[:n]))
+	assert.Equal(t, int64(17), server.stat.ioThreadedReadsProcessed)
+
+	// 同一批中被前面的客户端杀掉的客户端，IO线程已经解析好的命令不再执行
+	victim, victimPeer := newThreadedTestClient(t)
+	_, err = unix.Write(peers[1], []byte(fmt.Sprintf("client kill id %d\r\n", victim.id)))
+	assert.Nil(t, err)
+	_, err = unix.Write(victimPeer, []byte("set killed 1\r\n"))
+	assert.Nil(t, err)
+	server.aeLoop.AeProcess(server.aeLoop.AeWait())
+	// 保证被杀掉的客户端排在后面
+	if server.clientsPendingRead[0] == victim {
+		server.clientsPendingRead[0], server.clientsPendingRead[1] = server.clientsPendingRead[1], server.clientsPendingRead[0]
+	}
+	beforeSleep(server.aeLoop)
+	n, err = unix.Read(peers[1], buf)
+	assert.Nil(t, err)
+	assert.Equal(t, ":1\r\n", string(buf[:n]))
+	assert.Nil(t, server.db.data.Get(CreateObject(GSTR, "killed")))
+	assert.NotZero(t, victim.flags&CLIENT_CLOSED)
+
+	// 重新初始化时停掉IO线程
+	var empty Config
+	closeListeningSockets()
+	assert.Nil(t, initServer(&empty))
+	assert.Nil(t, server.ioThreads)
+}
+
+func TestIOThreadsTls(t *testing.T) {
+	ca, caKey, caPem, _ := genTestCert(t, "ca", nil, nil)
+	_, _, certPem, keyPem := genTestCert(t, "server", ca, caKey)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPem)
+	conf := Config{IoThreads: 2}
+	assert.Nil(t, initServer(&conf))
+	defer closeListeningSockets()
+	sa, err := unix.Getsockname(server.ipfd[0])
+	assert.Nil(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*unix.SockaddrInet4).Port)
+
+	done := make(chan error, 1)
+	var conn *tls.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	go func() {
+		var err error
+		conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+		if err == nil {
+			_, err = conn.Write([]byte("set k v\r\n"))
+		}
+		buf := make([]byte, len("+OK\r\n"))
+		if err == nil {
+			_, err = io.ReadFull(conn, buf)
+		}
+		done <- err
+		if err != nil {
+			return
+		}
+		buf = make([]byte, len("$4\r\ntls!\r\n"))
+		_, err = io.ReadFull(conn, buf)
+		if err == nil && string(buf) != "$4\r\ntls!\r\n" {
+			err = fmt.Errorf("unexpected reply %q", buf)
+		}
+		done <- err
+	}()
+	AcceptHandler(server.aeLoop, server.ipfd[0], &tls.Config{Certificates: []tls.Certificate{cert}})
+	assert.Nil(t, runLoopUntil(done))
+	tc := server.clientList[0]
+	assert.NotNil(t, tc.tls)
+
+	// 普通客户端足够多时由IO线程写，TLS连接仍然在主goroutine中写
+	peers := make([]int, 4)
+	for i := range peers {
+		var c *GoRedisClient
+		c, peers[i] = newThreadedTestClient(t)
+		c.AddReplyBulk("plain")
+	}
+	tc.AddReplyBulk("tls!")
+	written := server.stat.ioThreadedWritesProcessed
+	assert.Equal(t, 5, handleClientsWithPendingWrites())
+	assert.Equal(t, written+4, server.stat.ioThreadedWritesProcessed)
+	assert.False(t, tc.hasPendingReplies())
+	buf := make([]byte, 64)
+	for _, peer := range peers {
+		n, err := unix.Read(peer, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "$5\r\nplain\r\n", string(buf[:n]))
+	}
+	assert.Nil(t, <-done)
+}
+
+func TestIOThreadsConfig(t *testing.T) {
+	config := NewConfig()
+	assert.Equal(t, 1, config.IoThreads)
+	assert.NotNil(t, config.applyDirective("io-threads", []string{"0"}))
+	assert.NotNil(t, config.applyDirective("io-threads", []string{"129"}))
+	assert.Nil(t, config.applyDirective("io-threads", []string{"8"}))
+	assert.Equal(t, 8, config.IoThreads)
+}
+
+// benchmarkIOThreads 在一个goroutine中运行事件循环，clients个连接各自发送pipeline个命令再读回复
+func benchmarkIOThreads(b *testing.B, threads int) {
+	const clients = 64
+	const pipeline = 32
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	conf := Config{IoThreads: threads, Bind: []string{"127.0.0.1"}, ProtectedMode: false}
+	if err := initServer(&conf); err != nil {
+		b.Fatal(err)
+	}
+	sa, err := unix.Getsockname(server.ipfd[0])
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*unix.SockaddrInet4).Port)
+	var stop atomic.Bool
+	server.aeLoop.AddBeforeSleepProc(beforeSleep)
+	server.aeLoop.AddBeforeSleepProc(func(loop *AeLoop) {
+		if stop.Load() {
+			loop.stop = true
+		}
+	})
+	loopDone := make(chan struct{})
+	go func() {
+		server.aeLoop.AeMain()
+		close(loopDone)
+	}()
+	defer func() {
+		stop.Store(true)
+		<-loopDone
+		closeListeningSockets()
+		initThreadedIO()
+	}()
+
+	value := strings.Repeat("v", 64)
+	req := strings.Repeat("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$64\r\n"+value+"\r\n*2\r\n$3\r\nget\r\n$3\r\nkey\r\n", pipeline/2)
+	reply := strings.Repeat("+OK\r\n$64\r\n"+value+"\r\n", pipeline/2)
+	conns := make([]net.Conn, clients)
+	for i := range conns {
+		if conns[i], err = net.Dial("tcp", addr); err != nil {
+			b.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	b.SetBytes(int64(len(req)))
+	b.ResetTimer()
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			r := bufio.NewReader(conn)
+			buf := make([]byte, len(reply))
+			for next.Add(1) <= int64(b.N) {
+				if _, err := conn.Write([]byte(req)); err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := io.ReadFull(r, buf); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+	b.StopTimer()
+}
+
+func BenchmarkIOThreads(b *testing.B) {
+	for _, threads := range []int{1, 4} {
+		b.Run(fmt.Sprintf("io-threads=%d", threads), func(b *testing.B) {
+			benchmarkIOThreads(b, threads)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+func monitorCommand(c *GoRedisClient) {
+	// 已经在monitor模式中，不重复添加
+	if c.flags&CLIENT_MONITOR != 0 {
+		return
+	}
+	c.flags |= CLIENT_MONITOR
+	server.monitors = append(server.monitors, c)
+	c.AddReply(shared.ok)
+}
+
+func removeMonitor(c *GoRedisClient) {
+	for i, m := range server.monitors {
+		if m == c {
+			server.monitors = append(server.monitors[:i], server.monitors[i+1:]...)
+			break
+		}
+	}
+	c.flags &= ^CLIENT_MONITOR
+}
+
+// replicationFeedMonitors 把即将执行的命令推送给所有monitor，
+// 格式形如 +1339518083.107412 [0 127.0.0.1:60866] "set" "k" "v"，unix socket的客户端显示为 [0 unix:/tmp/redis.sock]
+func replicationFeedMonitors(c *GoRedisClient, cmd *GoRedisCommand) {
+	if len(server.monitors) == 0 || cmd.flags&(CMD_ADMIN|CMD_SKIP_MONITOR) != 0 {
+		return
+	}
+	now := time.Now()
+	var b strings.Builder
+	addr := c.addr
+	if c.flags&CLIENT_UNIX_SOCKET != 0 {
+		addr = "unix:" + server.config.Unixsocket
+	}
+	fmt.Fprintf(&b, "+%d.%06d [0 %s]", now.Unix(), now.Nanosecond()/1000, addr)
+	for _, arg := range c.args {
+		b.WriteByte(' ')
+		b.WriteString(quoteArg(arg.StrVal()))
+	}
+	b.WriteString("\r\n")
+	// 所有monitor共享同一个回复对象
+	msg := CreateObject(GSTR, b.String())
+	for _, m := range server.monitors {
+		m.AddReply(msg)
+	}
+	msg.DecrRefCount()
+}
@@ -1,32 +1,82 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net"
+	"os"
 
 	"golang.org/x/sys/unix"
 )
 
 const BACKLOG int = 64
 
-func Accept(fd int) (int, error) {
-	nfd, _, err := unix.Accept(fd)
-	// ignore client addr for now
-	// 忽略端口
-	return nfd, err
+// Accept 接受一个连接，同时返回对端的地址，客户端的fd是非阻塞的，读写不会卡住事件循环
+func Accept(fd int) (int, string, error) {
+	nfd, sa, err := unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+	if err != nil {
+		return -1, "", err
+	}
+	return nfd, sockaddrToString(sa), nil
 }
 
-func Connect(host [4]byte, port int) (int, error) {
-	s, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+// LocalAddr 返回fd本端的地址，形如 127.0.0.1:6379
+func LocalAddr(fd int) string {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return ""
+	}
+	return sockaddrToString(sa)
+}
+
+func sockaddrToString(sa unix.Sockaddr) string {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return fmt.Sprintf("%v:%v", net.IP(addr.Addr[:]).String(), addr.Port)
+	case *unix.SockaddrInet6:
+		return fmt.Sprintf("[%v]:%v", net.IP(addr.Addr[:]).String(), addr.Port)
+	case *unix.SockaddrUnix:
+		return addr.Name
+	}
+	return ""
+}
+
+// parseSockaddr 把 ip + port 转换为sockaddr，"*" 和 "::*" 分别表示所有的IPv4和IPv6地址
+func parseSockaddr(host string, port int) (int, unix.Sockaddr, error) {
+	switch host {
+	case "*":
+		return unix.AF_INET, &unix.SockaddrInet4{Port: port}, nil
+	case "::*":
+		return unix.AF_INET6, &unix.SockaddrInet6{Port: port}, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return -1, nil, fmt.Errorf("invalid address '%v'", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := &unix.SockaddrInet4{Port: port}
+		copy(addr.Addr[:], ip4)
+		return unix.AF_INET, addr, nil
+	}
+	addr := &unix.SockaddrInet6{Port: port}
+	copy(addr.Addr[:], ip)
+	return unix.AF_INET6, addr, nil
+}
+
+// Connect 连接host:port，host可以是IPv4或者IPv6地址
+func Connect(host string, port int) (int, error) {
+	domain, addr, err := parseSockaddr(host, port)
 	if err != nil {
-		log.Printf("init socket err: %v\n", err)
 		return -1, err
 	}
-	addr := unix.SockaddrInet4{
-		Addr: host,
-		Port: port,
+	s, err := unix.Socket(domain, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		log.Printf("init socket err: %v\n", err)
+		return -1, err
 	}
-	if err = unix.Connect(s, &addr); err != nil {
+	if err = unix.Connect(s, addr); err != nil {
 		log.Printf("connect err: %v\n", err)
+		unix.Close(s)
 		return -1, err
 	}
 	return s, nil
@@ -40,40 +90,99 @@ func Write(fd int, buf []byte) (int, error) {
 	return unix.Write(fd, buf)
 }
 
+// Writev 把多块数据在一次系统调用中写出
+func Writev(fd int, bufs [][]byte) (int, error) {
+	return unix.Writev(fd, bufs)
+}
+
 func Close(fd int) {
 	unix.Close(fd)
 }
 
-// TcpServer 监听端口，并返回一个fd
-func TcpServer(port int) (int, error) {
-	s, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+// TcpServer 监听host:port，并返回一个fd，host为 "*" 时监听所有的IPv4地址
+func TcpServer(host string, port int) (int, error) {
+	domain, addr, err := parseSockaddr(host, port)
+	if err != nil {
+		return -1, err
+	}
+	s, err := unix.Socket(domain, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
 	if err != nil {
 		log.Printf("init socket err: %v\n", err)
-		return -1, nil
+		return -1, err
 	}
 	defer func() {
 		if err != nil {
 			unix.Close(s)
 		}
 	}()
-	if err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEADDR, port); err != nil {
+	if err = unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
 		log.Printf("set SO_REUSEADDR err: %v\n", err)
-		return -1, nil
+		return -1, err
+	}
+	// IPv6的socket只接受IPv6连接，IPv4由另外一个fd监听，这样 "* ::*" 可以同时绑定
+	if domain == unix.AF_INET6 {
+		if err = unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1); err != nil {
+			log.Printf("set IPV6_V6ONLY err: %v\n", err)
+			return -1, err
+		}
 	}
 	// golang.syscall will handle htons
 	// 这个函数已经完成大小段转换的问题
-	// golang will set addr.Addr = interface{}(0)
-	addr := unix.SockaddrInet4{
-		Port: port,
-	}
-	if err = unix.Bind(s, &addr); err != nil {
+	if err = unix.Bind(s, addr); err != nil {
 		log.Printf("bind addr err: %v\n", err)
-		return -1, nil
+		return -1, err
 	}
 	if err = unix.Listen(s, BACKLOG); err != nil {
 		log.Printf("listen socket err: %v\n", err)
-		return -1, nil
+		return -1, err
 	}
 	return s, nil
+}
 
+// UnixServer 在path上监听unix socket，perm不为0时修改socket文件的权限
+func UnixServer(path string, perm uint32) (int, error) {
+	if err := RemoveStaleSocket(path); err != nil {
+		log.Printf("remove stale socket err: %v\n", err)
+		return -1, err
+	}
+	s, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		log.Printf("init unix socket err: %v\n", err)
+		return -1, err
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(s)
+		}
+	}()
+	if err = unix.Bind(s, &unix.SockaddrUnix{Name: path}); err != nil {
+		log.Printf("bind unix socket err: %v\n", err)
+		return -1, err
+	}
+	if perm != 0 {
+		if err = unix.Chmod(path, perm); err != nil {
+			log.Printf("chmod unix socket err: %v\n", err)
+			return -1, err
+		}
+	}
+	if err = unix.Listen(s, BACKLOG); err != nil {
+		log.Printf("listen unix socket err: %v\n", err)
+		return -1, err
+	}
+	return s, nil
+}
+
+// RemoveStaleSocket 删除上次没有清理掉的socket文件，同名的普通文件不会被删除
+func RemoveStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+	return os.Remove(path)
 }
@@ -9,14 +9,14 @@ import (
 )
 
 func EchoServer(s, c, e chan struct{}) {
-	sfd, err := TcpServer(6666)
+	sfd, err := TcpServer("*", 6666)
 	if err != nil {
 		fmt.Printf("tcp server error: %v\n", err)
 	}
 	fmt.Println("server started")
 	s <- struct{}{}
 	<-c
-	cfd, err := Accept(sfd)
+	cfd, _, err := Accept(sfd)
 	fmt.Printf("accepted cfd: %v\n", cfd)
 	if err != nil {
 		fmt.Printf("server accpet error: %v\n", err)
@@ -43,7 +43,7 @@ func useTestAeInstead(t *testing.T) {
 	e := make(chan struct{})
 	go EchoServer(s, c, e)
 	<-s
-	host := [4]byte{127, 0, 0, 1}
+	host := "127.0.0.1"
 	cfd, err := Connect(host, 6666)
 	fmt.Printf("connected cfd: %v\n", cfd)
 	time.Sleep(100 * time.Millisecond)
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 客户端使用的协议版本，通过HELLO切换
+const (
+	RESP2 int = 2
+	RESP3 int = 3
+)
+
+const (
+	PROTO_REPLY_CHUNK_BYTES  int = 16 * 1024 // 客户端固定回复缓冲区以及链表中每个块的大小
+	NET_MAX_WRITES_PER_EVENT int = 64 * 1024 // 一次写事件最多写出的字节数
+	NET_IOV_MAX              int = 64        // 一次writev最多的块数
+)
+
+// replyBlock 回复链表中的一个块，buf的len是已经使用的长度，cap是块的大小
+type replyBlock struct {
+	buf []byte
+}
+
+// hasPendingReplies 是否还有没有发送完的回复
+func (c *GoRedisClient) hasPendingReplies() bool {
+	return len(c.buf) > 0 || len(c.reply) > 0 || (c.tls != nil && c.tls.pending())
+}
+
+// prepareClientToWrite 有回复时把客户端放进clientsPendingWrite，
+// 等到beforeSleep再统一写出，返回false表示不需要再回复这个客户端
+func (c *GoRedisClient) prepareClientToWrite() bool {
+	if c.flags&(CLIENT_REPLY_OFF|CLIENT_REPLY_SKIP|CLIENT_CLOSE_AFTER_REPLY|CLIENT_CLOSE_ASAP|CLIENT_CLOSED) != 0 {
+		return false
+	}
+	if c.flags&CLIENT_PENDING_WRITE == 0 && !c.hasPendingReplies() {
+		c.flags |= CLIENT_PENDING_WRITE
+		server.clientsPendingWrite = append(server.clientsPendingWrite, c)
+	}
+	return true
+}
+
+// addReplyProto 写入编码好的协议内容，优先写进固定缓冲区，放不下的部分追加到回复链表
+func (c *GoRedisClient) addReplyProto(s string) {
+	if !c.prepareClientToWrite() {
+		return
+	}
+	// 链表中已经有内容时不能再写buf，否则回复的顺序会乱
+	if len(c.reply) == 0 {
+		n := cap(c.buf) - len(c.buf)
+		if n > len(s) {
+			n = len(s)
+		}
+		c.buf = append(c.buf, s[:n]...)
+		s = s[n:]
+	}
+	if len(s) == 0 {
+		return
+	}
+	// 先填满最后一个块的剩余空间
+	if len(c.reply) > 0 {
+		tail := c.reply[len(c.reply)-1]
+		n := cap(tail.buf) - len(tail.buf)
+		if n > len(s) {
+			n = len(s)
+		}
+		tail.buf = append(tail.buf, s[:n]...)
+		c.replyBytes += int64(n)
+		s = s[n:]
+	}
+	if len(s) > 0 {
+		size := PROTO_REPLY_CHUNK_BYTES
+		if len(s) > size {
+			size = len(s)
+		}
+		blk := &replyBlock{buf: make([]byte, 0, size)}
+		blk.buf = append(blk.buf, s...)
+		c.reply = append(c.reply, blk)
+		c.replyBytes += int64(len(s))
+	}
+	c.closeClientOnOutputBufferLimitReached()
+}
+
+// checkClientOutputBufferLimits 回复链表的大小是否超过了这类客户端的限制，
+// 超过soft limit时记录开始的时间，持续超过softSeconds才算
+func checkClientOutputBufferLimits(c *GoRedisClient) bool {
+	if server.config == nil {
+		return false
+	}
+	limit := server.config.ClientObufLimits[getClientType(c)]
+	hard := limit.hard > 0 && c.replyBytes >= limit.hard
+	soft := limit.soft > 0 && c.replyBytes >= limit.soft
+	if soft {
+		now := time.Now().Unix()
+		if c.obufSoftLimitReachedTime == 0 {
+			c.obufSoftLimitReachedTime = now
+			soft = false
+		} else if now-c.obufSoftLimitReachedTime <= limit.softSeconds {
+			soft = false
+		}
+	} else {
+		c.obufSoftLimitReachedTime = 0
+	}
+	return soft || hard
+}
+
+// closeClientOnOutputBufferLimitReached 超过限制的客户端异步关闭，剩下的回复也不再发送
+func (c *GoRedisClient) closeClientOnOutputBufferLimitReached() {
+	if c.flags&(CLIENT_CLOSE_ASAP|CLIENT_CLOSED) != 0 || !checkClientOutputBufferLimits(c) {
+		return
+	}
+	log.Printf("Client %v scheduled to be closed ASAP for overcoming of output buffer limits.\n", catClientInfoString(c))
+	server.stat.obufLimitDisconnections++
+	freeClientAsync(c)
+}
+
+// consumeReply 已经发送了n字节，释放发送完的buf和块
+func (c *GoRedisClient) consumeReply(n int) {
+	if len(c.buf) > 0 {
+		c.sentLen += n
+		if c.sentLen < len(c.buf) {
+			return
+		}
+		n = c.sentLen - len(c.buf)
+		c.buf = c.buf[:0]
+		c.sentLen = 0
+	}
+	for len(c.reply) > 0 {
+		blk := c.reply[0]
+		c.sentLen += n
+		if c.sentLen < len(blk.buf) {
+			return
+		}
+		// 长度为0的是没有填充的占位块，直接丢弃
+		n = c.sentLen - len(blk.buf)
+		c.replyBytes -= int64(len(blk.buf))
+		c.reply[0] = nil
+		c.reply = c.reply[1:]
+		c.sentLen = 0
+	}
+}
+
+// 小于这个长度的聚合类型头部使用共享对象
+const OBJ_SHARED_HDR_LEN = 32
+
+// sharedObjects 常用的回复提前创建好，直接挂到回复链表上，引用计数不会降到0
+type sharedObjects struct {
+	crlf, ok, czero, cone, emptyBulk, emptyArray *GObj
+	syntaxErr, wrongTypeErr, notIntegerErr       *GObj
+	noAuthErr, noPermKeyErr, wrongPassErr        *GObj
+	noPermChannelErr                             *GObj
+	null                                         [RESP3 + 1]*GObj // 下标是协议版本
+	nullArray                                    [RESP3 + 1]*GObj
+	mbulkHdr                                     [OBJ_SHARED_HDR_LEN]*GObj // *<n>\r\n
+	bulkHdr                                      [OBJ_SHARED_HDR_LEN]*GObj // $<n>\r\n
+	mapHdr                                       [OBJ_SHARED_HDR_LEN]*GObj // %<n>\r\n
+	setHdr                                       [OBJ_SHARED_HDR_LEN]*GObj // ~<n>\r\n
+}
+
+var shared = createSharedObjects()
+
+func createSharedObjects() *sharedObjects {
+	str := func(s string) *GObj {
+		return CreateObject(GSTR, s)
+	}
+	s := &sharedObjects{
+		crlf:             str("\r\n"),
+		ok:               str("+OK\r\n"),
+		czero:            str(":0\r\n"),
+		cone:             str(":1\r\n"),
+		emptyBulk:        str("$0\r\n\r\n"),
+		emptyArray:       str("*0\r\n"),
+		syntaxErr:        str("-ERR syntax error\r\n"),
+		wrongTypeErr:     str("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"),
+		notIntegerErr:    str("-ERR value is not an integer or out of range\r\n"),
+		noAuthErr:        str("-NOAUTH Authentication required.\r\n"),
+		noPermKeyErr:     str("-NOPERM No permissions to access a key\r\n"),
+		noPermChannelErr: str("-NOPERM No permissions to access a channel\r\n"),
+		wrongPassErr:     str("-WRONGPASS invalid username-password pair or user is disabled.\r\n"),
+	}
+	s.null[RESP2] = str("$-1\r\n")
+	s.null[RESP3] = str("_\r\n")
+	s.nullArray[RESP2] = str("*-1\r\n")
+	s.nullArray[RESP3] = str("_\r\n")
+	for i := 0; i < OBJ_SHARED_HDR_LEN; i++ {
+		n := strconv.Itoa(i)
+		s.mbulkHdr[i] = str("*" + n + "\r\n")
+		s.bulkHdr[i] = str("$" + n + "\r\n")
+		s.mapHdr[i] = str("%" + n + "\r\n")
+		s.setHdr[i] = str("~" + n + "\r\n")
+	}
+	return s
+}
+
+// addReplyLongLongWithPrefix 回复形如 <prefix><n>\r\n 的头部，小的长度直接使用共享对象
+func (c *GoRedisClient) addReplyLongLongWithPrefix(n int64, prefix byte) {
+	if n >= 0 && n < OBJ_SHARED_HDR_LEN {
+		switch prefix {
+		case '*':
+			c.AddReply(shared.mbulkHdr[n])
+			return
+		case '$':
+			c.AddReply(shared.bulkHdr[n])
+			return
+		case '%':
+			c.AddReply(shared.mapHdr[n])
+			return
+		case '~':
+			c.AddReply(shared.setHdr[n])
+			return
+		}
+	}
+	c.AddReplyStr(string(prefix) + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// AddReplyBulk 回复一个bulk string，形如 $3\r\nval\r\n
+func (c *GoRedisClient) AddReplyBulk(str string) {
+	if len(str) == 0 {
+		c.AddReply(shared.emptyBulk)
+		return
+	}
+	// 头部和内容拼成一个节点，避免一次回复占用三个节点
+	c.AddReplyStr("$" + strconv.Itoa(len(str)) + "\r\n" + str + "\r\n")
+}
+
+// AddReplyInt 回复一个整数，形如 :1\r\n
+func (c *GoRedisClient) AddReplyInt(n int64) {
+	switch n {
+	case 0:
+		c.AddReply(shared.czero)
+	case 1:
+		c.AddReply(shared.cone)
+	default:
+		c.addReplyLongLongWithPrefix(n, ':')
+	}
+}
+
+// AddReplyArrayLen 回复数组的头部，后面需要跟着n个元素
+func (c *GoRedisClient) AddReplyArrayLen(n int) {
+	c.addReplyLongLongWithPrefix(int64(n), '*')
+}
+
+// AddReplyMapLen 回复map的头部，后面需要跟着n对key value，RESP2下是2n个元素的数组
+func (c *GoRedisClient) AddReplyMapLen(n int) {
+	if c.resp == RESP3 {
+		c.addReplyLongLongWithPrefix(int64(n), '%')
+	} else {
+		c.AddReplyArrayLen(n * 2)
+	}
+}
+
+// AddReplySetLen 回复集合的头部，RESP2下是普通数组
+func (c *GoRedisClient) AddReplySetLen(n int) {
+	if c.resp == RESP3 {
+		c.addReplyLongLongWithPrefix(int64(n), '~')
+	} else {
+		c.AddReplyArrayLen(n)
+	}
+}
+
+// AddReplyPushLen 回复服务端主动推送的消息头部，RESP2下是普通数组
+func (c *GoRedisClient) AddReplyPushLen(n int) {
+	if c.resp == RESP3 {
+		c.addReplyLongLongWithPrefix(int64(n), '>')
+	} else {
+		c.AddReplyArrayLen(n)
+	}
+}
+
+// AddReplyDeferredLen 元素个数事先不知道时先在回复链表中放一个空块占位，
+// 等元素写完之后再用 SetDeferred*Len 填上头部
+func (c *GoRedisClient) AddReplyDeferredLen() *replyBlock {
+	blk := &replyBlock{}
+	if c.prepareClientToWrite() {
+		c.reply = append(c.reply, blk)
+	}
+	return blk
+}
+
+// replyBlockQueued 占位块是否还在回复链表中，没有挂上去或者已经被丢弃的块不再计入回复的大小
+func (c *GoRedisClient) replyBlockQueued(blk *replyBlock) bool {
+	for i := len(c.reply) - 1; i >= 0; i-- {
+		if c.reply[i] == blk {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *GoRedisClient) setDeferredReply(blk *replyBlock, prefix byte, n int) {
+	if !c.replyBlockQueued(blk) {
+		return
+	}
+	blk.buf = append(blk.buf, string(prefix)+strconv.Itoa(n)+"\r\n"...)
+	c.replyBytes += int64(len(blk.buf))
+	c.closeClientOnOutputBufferLimitReached()
+}
+
+// SetDeferredArrayLen 填充 AddReplyDeferredLen 占位的数组头部
+func (c *GoRedisClient) SetDeferredArrayLen(blk *replyBlock, n int) {
+	c.setDeferredReply(blk, '*', n)
+}
+
+// SetDeferredMapLen 填充占位的map头部，n是key value的对数
+func (c *GoRedisClient) SetDeferredMapLen(blk *replyBlock, n int) {
+	if c.resp == RESP3 {
+		c.setDeferredReply(blk, '%', n)
+	} else {
+		c.setDeferredReply(blk, '*', n*2)
+	}
+}
+
+// SetDeferredSetLen 填充占位的集合头部
+func (c *GoRedisClient) SetDeferredSetLen(blk *replyBlock, n int) {
+	if c.resp == RESP3 {
+		c.setDeferredReply(blk, '~', n)
+	} else {
+		c.setDeferredReply(blk, '*', n)
+	}
+}
+
+// AddReplyNull RESP3下是_，RESP2下是空的bulk string
+func (c *GoRedisClient) AddReplyNull() {
+	c.AddReply(shared.null[c.resp])
+}
+
+// AddReplyNullArray RESP3下是_，RESP2下是空数组
+func (c *GoRedisClient) AddReplyNullArray() {
+	c.AddReply(shared.nullArray[c.resp])
+}
+
+// AddReplyBool RESP2下用整数1和0表示
+func (c *GoRedisClient) AddReplyBool(b bool) {
+	if c.resp == RESP3 {
+		if b {
+			c.AddReplyStr("#t\r\n")
+		} else {
+			c.AddReplyStr("#f\r\n")
+		}
+	} else if b {
+		c.AddReplyInt(1)
+	} else {
+		c.AddReplyInt(0)
+	}
+}
+
+// formatDouble 按照redis的%.17g格式化浮点数
+func formatDouble(d float64) string {
+	switch {
+	case math.IsInf(d, 1):
+		return "inf"
+	case math.IsInf(d, -1):
+		return "-inf"
+	case math.IsNaN(d):
+		return "nan"
+	}
+	return strconv.FormatFloat(d, 'g', 17, 64)
+}
+
+// AddReplyDouble RESP2下用bulk string表示
+func (c *GoRedisClient) AddReplyDouble(d float64) {
+	if c.resp == RESP3 {
+		c.AddReplyStr("," + formatDouble(d) + "\r\n")
+	} else {
+		c.AddReplyBulk(formatDouble(d))
+	}
+}
+
+// AddReplyBigNum 大整数，RESP2下用bulk string表示
+func (c *GoRedisClient) AddReplyBigNum(num string) {
+	if c.resp == RESP3 {
+		c.AddReplyStr("(" + num + "\r\n")
+	} else {
+		c.AddReplyBulk(num)
+	}
+}
+
+// AddReplyVerbatim 带格式的文本，ext是三个字符的格式，例如txt，RESP2下用bulk string表示
+func (c *GoRedisClient) AddReplyVerbatim(str, ext string) {
+	if c.resp == RESP3 {
+		c.AddReplyStr(fmt.Sprintf("=%d\r\n%s:%s\r\n", len(str)+len(ext)+1, ext, str))
+	} else {
+		c.AddReplyBulk(str)
+	}
+}
+
+// AddReplyStatus 回复一个状态，形如 +OK\r\n
+func (c *GoRedisClient) AddReplyStatus(status string) {
+	c.AddReplyStr("+" + status + "\r\n")
+}
+
+// AddReplyErrorObject 回复一个共享的错误对象
+func (c *GoRedisClient) AddReplyErrorObject(o *GObj) {
+	c.AddReply(o)
+	server.stat.errorReplies++
+}
+
+// AddReplyError 回复一个错误，默认加上ERR错误码，以-开头的msg自带错误码，例如 -WRONGTYPE ...
+func (c *GoRedisClient) AddReplyError(msg string) {
+	// 错误只能占一行，换行会破坏协议
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	if strings.HasPrefix(msg, "-") {
+		c.AddReplyStr(msg + "\r\n")
+	} else {
+		c.AddReplyStr("-ERR " + msg + "\r\n")
+	}
+	server.stat.errorReplies++
+}
+
+// AddReplyErrorFormat 同 AddReplyError，支持格式化
+func (c *GoRedisClient) AddReplyErrorFormat(format string, args ...interface{}) {
+	c.AddReplyError(fmt.Sprintf(format, args...))
+}
+
+// AddReplyHelp 回复子命令的帮助信息
+func (c *GoRedisClient) AddReplyHelp(lines []string) {
+	c.AddReplyArrayLen(len(lines))
+	for _, line := range lines {
+		c.AddReplyStatus(line)
+	}
+}
+
+// validClientName 客户端名字不能包含空格和特殊字符
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// helloCommand HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloCommand(c *GoRedisClient) {
+	ver := c.resp
+	if len(c.args) >= 2 {
+		v, err := strconv.Atoi(c.args[1].StrVal())
+		if err != nil {
+			c.AddReplyError("Protocol version is not an integer or out of range")
+			return
+		}
+		if v < RESP2 || v > RESP3 {
+			c.AddReplyError("-NOPROTO unsupported protocol version")
+			return
+		}
+		ver = v
+	}
+	var username, pass, name string
+	setname := false
+	for i := 2; i < len(c.args); i++ {
+		remaining := len(c.args) - i - 1
+		opt := c.args[i].StrVal()
+		if strings.EqualFold(opt, "auth") && remaining >= 2 {
+			username, pass = c.args[i+1].StrVal(), c.args[i+2].StrVal()
+			i += 2
+		} else if strings.EqualFold(opt, "setname") && remaining >= 1 {
+			name = c.args[i+1].StrVal()
+			setname = true
+			i++
+		} else {
+			c.AddReplyErrorFormat("Syntax error in HELLO option '%s'", opt)
+			return
+		}
+	}
+	if setname && !validClientName(name) {
+		c.AddReplyError("Client names cannot contain spaces, newlines or special characters.")
+		return
+	}
+	if username != "" {
+		if !aclAuthenticate(c, username, pass) {
+			c.AddReplyErrorObject(shared.wrongPassErr)
+			return
+		}
+	} else if authRequired(c) {
+		c.AddReplyError("-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+	if setname {
+		c.name = name
+	}
+	// 先切换协议，下面的回复已经使用新的协议
+	c.resp = ver
+	c.AddReplyMapLen(7)
+	c.AddReplyBulk("server")
+	c.AddReplyBulk("redis")
+	c.AddReplyBulk("version")
+	c.AddReplyBulk(REDIS_VERSION)
+	c.AddReplyBulk("proto")
+	c.AddReplyInt(int64(c.resp))
+	c.AddReplyBulk("id")
+	c.AddReplyInt(c.id)
+	c.AddReplyBulk("mode")
+	c.AddReplyBulk("standalone")
+	c.AddReplyBulk("role")
+	c.AddReplyBulk("master")
+	c.AddReplyBulk("modules")
+	c.AddReplyArrayLen(0)
+}
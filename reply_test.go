@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// takeReply 取出客户端所有待发送的回复
+func takeReply(c *GoRedisClient) string {
+	var b strings.Builder
+	b.Write(c.buf)
+	for _, blk := range c.reply {
+		b.Write(blk.buf)
+	}
+	freeReplyList(c)
+	return b.String()
+}
+
+func TestReplyProtocols(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	c := CreateClient(server.ipfd[0])
+	write := func() {
+		c.AddReplyMapLen(1)
+		c.AddReplyBulk("k")
+		c.AddReplyBool(true)
+		c.AddReplySetLen(1)
+		c.AddReplyDouble(1.5)
+		c.AddReplyDouble(math.Inf(1))
+		c.AddReplyNull()
+		c.AddReplyNullArray()
+		c.AddReplyBigNum("1234567890123456789012")
+		c.AddReplyVerbatim("hi", "txt")
+		c.AddReplyPushLen(0)
+	}
+	write()
+	assert.Equal(t, "*2\r\n$1\r\nk\r\n:1\r\n*1\r\n$3\r\n1.5\r\n$3\r\ninf\r\n$-1\r\n*-1\r\n"+
+		"$22\r\n1234567890123456789012\r\n$2\r\nhi\r\n*0\r\n", takeReply(c))
+
+	c.resp = RESP3
+	write()
+	assert.Equal(t, "%1\r\n$1\r\nk\r\n#t\r\n~1\r\n,1.5\r\n,inf\r\n_\r\n_\r\n"+
+		"(1234567890123456789012\r\n=6\r\ntxt:hi\r\n>0\r\n", takeReply(c))
+}
+
+func TestHello(t *testing.T) {
+	conf := Config{Requirepass: "secret"}
+	initServer(&conf)
+	c := CreateClient(server.ipfd[0])
+	ReadQuery(c, "hello 3\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.True(t, strings.HasPrefix(takeReply(c), "-NOAUTH"))
+	assert.Equal(t, RESP2, c.resp)
+
+	ReadQuery(c, "hello 3 auth default secret setname app\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.True(t, strings.HasPrefix(takeReply(c), "%7\r\n$6\r\nserver\r\n"))
+	assert.Equal(t, RESP3, c.resp)
+	assert.Equal(t, "app", c.name)
+	assert.True(t, c.authenticated)
+
+	ReadQuery(c, "hello 4\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.Equal(t, "-NOPROTO unsupported protocol version\r\n", takeReply(c))
+	assert.Equal(t, RESP3, c.resp)
+}
+
+func TestReplyErrors(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	c := CreateClient(server.ipfd[0])
+	c.AddReplyError("bad\r\nthing")
+	c.AddReplyError("-WRONGTYPE custom")
+	c.AddReplyErrorFormat("value %d", 1)
+	assert.Equal(t, "-ERR bad  thing\r\n-WRONGTYPE custom\r\n-ERR value 1\r\n", takeReply(c))
+	assert.Equal(t, int64(3), server.stat.errorReplies)
+
+	node := c.AddReplyDeferredLen()
+	c.AddReplyInt(1)
+	c.AddReplyInt(42)
+	c.SetDeferredArrayLen(node, 2)
+	assert.Equal(t, "*2\r\n:1\r\n:42\r\n", takeReply(c))
+
+	ReadQuery(c, "nosuch a b\r\nget\r\nexpire k 10\r\nexpire k x\r\nset k v\r\nexpire k 10\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.Equal(t, "-ERR unknown command 'nosuch', with args beginning with: 'a' 'b' \r\n"+
+		"-ERR wrong number of arguments for 'get' command\r\n"+
+		":0\r\n-ERR value is not an integer or out of range\r\n+OK\r\n:1\r\n", takeReply(c))
+
+	server.db.data.Set(CreateObject(GSTR, "l"), CreateObject(GLIST, ListCreate(ListType{})))
+	ReadQuery(c, "get l\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.Equal(t, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", takeReply(c))
+}
+
+func TestReplyBuffer(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer unix.Close(fds[1])
+	c := CreateClient(fds[0])
+
+	// 固定缓冲区写满之后追加到回复链表
+	big := strings.Repeat("x", PROTO_REPLY_CHUNK_BYTES)
+	c.AddReplyBulk(big)
+	assert.Equal(t, PROTO_REPLY_CHUNK_BYTES, len(c.buf))
+	assert.Equal(t, 1, len(c.reply))
+	blk := c.AddReplyDeferredLen()
+	c.AddReplyInt(7)
+	c.SetDeferredArrayLen(blk, 1)
+	assert.Equal(t, 3, len(c.reply))
+	assert.Equal(t, []*GoRedisClient{c}, server.clientsPendingWrite)
+
+	expected := "$16384\r\n" + big + "\r\n*1\r\n:7\r\n"
+	assert.Equal(t, 1, handleClientsWithPendingWrites())
+	assert.False(t, c.hasPendingReplies())
+	assert.Equal(t, int64(0), c.replyBytes)
+	buf := make([]byte, len(expected)+1)
+	n := 0
+	for n < len(expected) {
+		m, err := unix.Read(fds[1], buf[n:])
+		assert.Nil(t, err)
+		n += m
+	}
+	assert.Equal(t, expected, string(buf[:n]))
+	freeClient(c)
+}
+
+func TestClientBufferLimits(t *testing.T) {
+	conf := Config{ClientQueryBufLimit: 16}
+	conf.ClientObufLimits[CLIENT_TYPE_NORMAL] = clientBufferLimit{hard: 1024}
+	conf.ClientObufLimits[CLIENT_TYPE_PUBSUB] = clientBufferLimit{soft: 10, softSeconds: 5}
+	initServer(&conf)
+
+	// 固定缓冲区不计入限制，超过hard limit的部分进入链表后立即断开
+	c := CreateClient(server.ipfd[0])
+	c.AddReplyBulk(strings.Repeat("x", PROTO_REPLY_CHUNK_BYTES+1024))
+	assert.NotZero(t, c.flags&CLIENT_CLOSE_ASAP)
+	assert.Equal(t, int64(1), server.stat.obufLimitDisconnections)
+
+	// soft limit需要持续超过softSeconds
+	c = CreateClient(server.ipfd[0])
+	c.flags |= CLIENT_PUBSUB
+	c.AddReplyBulk(strings.Repeat("x", PROTO_REPLY_CHUNK_BYTES))
+	assert.Zero(t, c.flags&CLIENT_CLOSE_ASAP)
+	assert.NotZero(t, c.obufSoftLimitReachedTime)
+	c.obufSoftLimitReachedTime -= 6
+	c.AddReplyInt(100)
+	assert.NotZero(t, c.flags&CLIENT_CLOSE_ASAP)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	defer unix.Close(fds[1])
+	c = CreateClient(fds[0])
+	_, err = unix.Write(fds[1], []byte("set k 0123456789abcdef"))
+	assert.Nil(t, err)
+	ReadQueryFromClient(server.aeLoop, fds[0], c)
+	assert.NotZero(t, c.flags&CLIENT_CLOSE_ASAP)
+	assert.Contains(t, genInfoString([]string{"stats"}), "client_query_buffer_limit_disconnections:1\r\n")
+	freeClientsInAsyncFreeQueue()
+}
+
+func TestDeferredReplyAccounting(t *testing.T) {
+	var conf Config
+	initServer(&conf)
+	c := CreateClient(server.ipfd[0])
+
+	// CLIENT REPLY OFF时占位块没有挂到回复链表上，填充头部不能计入回复的大小
+	ReadQuery(c, "client reply off\r\ncommand info get\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.False(t, c.hasPendingReplies())
+	assert.Equal(t, int64(0), c.replyBytes)
+	ReadQuery(c, "client reply on\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.Equal(t, "+OK\r\n", takeReply(c))
+
+	// 还没有填充就被丢弃的占位块也不计入
+	blk := c.AddReplyDeferredLen()
+	c.consumeReply(0)
+	c.SetDeferredArrayLen(blk, 3)
+	assert.False(t, c.hasPendingReplies())
+	assert.Equal(t, int64(0), c.replyBytes)
+
+	// 填充头部之后检查输出缓冲区的限制
+	server.config.ClientObufLimits[CLIENT_TYPE_NORMAL] = clientBufferLimit{hard: 4}
+	blk = c.AddReplyDeferredLen()
+	c.SetDeferredArrayLen(blk, 100)
+	assert.Equal(t, int64(6), c.replyBytes)
+	assert.NotZero(t, c.flags&CLIENT_CLOSE_ASAP)
+	freeClientsInAsyncFreeQueue()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SHUTDOWN 的参数
+const (
+	SHUTDOWN_NOFLAGS int = 0
+	SHUTDOWN_SAVE    int = 1 << 0 // 即使没有配置持久化也要保存
+	SHUTDOWN_NOSAVE  int = 1 << 1 // 不保存
+	SHUTDOWN_NOW     int = 1 << 2 // 不等待回复发送完
+	SHUTDOWN_FORCE   int = 1 << 3 // 保存失败也要退出
+)
+
+var errShutdown = errors.New("Errors trying to SHUTDOWN. Check logs.")
+
+// isShutdownInitiated 是否正在等待回复发送完
+func isShutdownInitiated() bool {
+	return server.shutdownMstime != 0
+}
+
+// prepareForShutdown 先关闭监听的fd不再接受新连接，然后在shutdown-timeout之内等待回复发送完，
+// NOW或者没有配置等待时间时直接退出
+func prepareForShutdown(flags int) error {
+	log.Printf("User requested shutdown...\n")
+	server.shutdownFlags = flags
+	closeListeningSockets()
+	timeout := server.config.ShutdownTimeout
+	if flags&SHUTDOWN_NOW == 0 && timeout > 0 {
+		server.shutdownMstime = GetMsTime() + int64(timeout)*1000
+		// 等待期间暂停写命令，否则客户端不断产生新的回复，只能等到超时
+		pauseActions(PAUSE_DURING_SHUTDOWN, math.MaxInt64, CLIENT_PAUSE_WRITE)
+		log.Printf("Waiting for pending replies before shutting down, timeout %vs\n", timeout)
+		return nil
+	}
+	// 没有等待阶段，失败时也要恢复监听
+	server.shutdownMstime = GetMsTime()
+	return finishShutdown()
+}
+
+// isReadyToShutdown 所有客户端的回复都已经发送完
+func isReadyToShutdown() bool {
+	for _, c := range server.clientList {
+		if c.hasPendingReplies() {
+			return false
+		}
+	}
+	return true
+}
+
+// checkShutdownProgress 在beforeSleep中检查回复是否发送完，或者已经超过了等待时间
+func checkShutdownProgress() {
+	if !isShutdownInitiated() {
+		return
+	}
+	if !isReadyToShutdown() {
+		if GetMsTime() < server.shutdownMstime {
+			return
+		}
+		log.Printf("Pending replies were not sent within shutdown-timeout, shutting down anyway\n")
+	}
+	_ = finishShutdown()
+}
+
+// finishShutdown 保存数据，删除pid文件并让事件循环退出，失败时取消关闭
+func finishShutdown() error {
+	flags := server.shutdownFlags
+	// 目前没有实现持久化，默认不需要保存，明确要求SAVE时只有FORCE才能继续退出
+	if flags&SHUTDOWN_SAVE != 0 {
+		log.Printf("Error trying to save the DB: persistence is not supported\n")
+		if flags&SHUTDOWN_FORCE == 0 {
+			_ = abortShutdown()
+			return errShutdown
+		}
+		log.Printf("Error trying to save the DB, but FORCE was used, exiting anyway\n")
+	}
+	removePidFile()
+	// 最后一次尽量把回复写出去，客户端的连接在进程退出时关闭
+	handleClientsWithPendingWrites()
+	server.shutdownMstime = 0
+	server.shutdownClients = nil
+	server.aeLoop.stop = true
+	log.Printf("go-redis is now ready to exit, bye bye...\n")
+	return nil
+}
+
+// abortShutdown 取消正在进行的关闭，恢复监听，等待中的SHUTDOWN客户端收到错误
+func abortShutdown() error {
+	if !isShutdownInitiated() {
+		return errors.New("No shutdown in progress.")
+	}
+	server.shutdownMstime = 0
+	server.shutdownFlags = 0
+	server.shutdownAsap.Store(0)
+	unpauseActions(PAUSE_DURING_SHUTDOWN)
+	if err := openListeningSockets(); err != nil {
+		log.Printf("failed to reopen listening sockets: %v\n", err)
+	}
+	for _, c := range server.shutdownClients {
+		if c.flags&CLIENT_CLOSED != 0 {
+			continue
+		}
+		c.AddReplyError(errShutdown.Error())
+		freeArgs(c)
+		resetClient(c)
+		// 在beforeSleep中继续处理它后面的请求
+		server.unblockedClients = append(server.unblockedClients, c)
+	}
+	server.shutdownClients = nil
+	log.Printf("Shutdown manually aborted.\n")
+	return nil
+}
+
+// SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+func shutdownCommand(c *GoRedisClient) {
+	flags := SHUTDOWN_NOFLAGS
+	abort := false
+	for _, arg := range c.args[1:] {
+		switch strings.ToLower(arg.StrVal()) {
+		case "nosave":
+			flags |= SHUTDOWN_NOSAVE
+		case "save":
+			flags |= SHUTDOWN_SAVE
+		case "now":
+			flags |= SHUTDOWN_NOW
+		case "force":
+			flags |= SHUTDOWN_FORCE
+		case "abort":
+			abort = true
+		default:
+			c.AddReplyErrorObject(shared.syntaxErr)
+			return
+		}
+	}
+	if (abort && flags != SHUTDOWN_NOFLAGS) || (flags&SHUTDOWN_SAVE != 0 && flags&SHUTDOWN_NOSAVE != 0) {
+		c.AddReplyErrorObject(shared.syntaxErr)
+		return
+	}
+	if abort {
+		if err := abortShutdown(); err != nil {
+			c.AddReplyError(err.Error())
+			return
+		}
+		c.AddReply(shared.ok)
+		return
+	}
+	var err error
+	if isShutdownInitiated() {
+		// 已经在等待中，新的参数合并进去，NOW立即退出
+		server.shutdownFlags |= flags
+		if flags&SHUTDOWN_NOW != 0 {
+			err = finishShutdown()
+		}
+	} else {
+		err = prepareForShutdown(flags)
+	}
+	if err != nil {
+		c.AddReplyError(err.Error())
+		return
+	}
+	// 成功时不回复，等到退出时连接被关闭
+	if isShutdownInitiated() {
+		c.flags |= CLIENT_BLOCKED
+		server.shutdownClients = append(server.shutdownClients, c)
+	}
+}
+
+// setupSignalHandlers SIGTERM/SIGINT 和SHUTDOWN走同样的流程，关闭过程中再次收到SIGINT时立即退出
+func setupSignalHandlers() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range ch {
+			if server.shutdownAsap.Load() != 0 && sig == syscall.SIGINT {
+				log.Printf("You insist... exiting now.\n")
+				removePidFile()
+				os.Exit(1)
+			}
+			log.Printf("Received %v scheduling shutdown...\n", sig)
+			server.shutdownAsap.Store(1)
+		}
+	}()
+}
+
+func createPidFile() error {
+	if server.config.Pidfile == "" {
+		return nil
+	}
+	return os.WriteFile(server.config.Pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+func removePidFile() {
+	if server.config.Pidfile == "" {
+		return
+	}
+	if err := os.Remove(server.config.Pidfile); err != nil && !os.IsNotExist(err) {
+		log.Printf("remove pid file err: %v\n", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		Unixsocket:      filepath.Join(dir, "redis.sock"),
+		Pidfile:         filepath.Join(dir, "redis.pid"),
+		ShutdownTimeout: 10,
+	}
+	assert.Nil(t, initServer(&conf))
+	assert.Nil(t, createPidFile())
+	a := newTestClient(t, "127.0.0.1:1000")
+	b := newTestClient(t, "127.0.0.1:2000")
+
+	ReadQuery(a, "shutdown save nosave\r\nshutdown abort now\r\nshutdown abort\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.Equal(t, "-ERR syntax error\r\n-ERR syntax error\r\n-ERR No shutdown in progress.\r\n", takeReply(a))
+
+	// 等待回复发送完的时候不再接受新连接，SHUTDOWN的客户端在退出前不会收到回复
+	a.AddReplyBulk("pending")
+	ReadQuery(b, "shutdown\r\nset k v\r\n")
+	assert.Nil(t, ProcessQueryBuf(b))
+	assert.True(t, isShutdownInitiated())
+	assert.NotZero(t, b.flags&CLIENT_BLOCKED)
+	assert.Equal(t, 0, len(server.ipfd))
+	_, err := os.Stat(conf.Unixsocket)
+	assert.True(t, os.IsNotExist(err))
+	checkShutdownProgress()
+	assert.False(t, server.aeLoop.stop)
+
+	// ABORT之后恢复监听，等待中的客户端收到错误并继续处理后面的请求
+	ReadQuery(a, "shutdown abort\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.False(t, isShutdownInitiated())
+	assert.NotEqual(t, 0, len(server.ipfd))
+	_, err = os.Stat(conf.Unixsocket)
+	assert.Nil(t, err)
+	processUnblockedClients()
+	assert.Equal(t, "-ERR Errors trying to SHUTDOWN. Check logs.\r\n+OK\r\n", takeReply(b))
+
+	// 没有持久化，SAVE只有和FORCE一起用才能退出
+	ReadQuery(a, "shutdown save now\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	assert.Equal(t, "$7\r\npending\r\n+OK\r\n-ERR Errors trying to SHUTDOWN. Check logs.\r\n", takeReply(a))
+	assert.False(t, server.aeLoop.stop)
+	assert.NotEqual(t, 0, len(server.ipfd))
+
+	// 回复都发送完之后在beforeSleep中退出
+	ReadQuery(a, "shutdown nosave\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	beforeSleep(server.aeLoop)
+	assert.True(t, server.aeLoop.stop)
+	_, err = os.Stat(conf.Pidfile)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(conf.Unixsocket)
+	assert.True(t, os.IsNotExist(err))
+
+	// 收到SIGTERM之后在ServerCron中开始关闭，NOW不等待
+	assert.Nil(t, initServer(&conf))
+	server.shutdownAsap.Store(1)
+	ServerCron(server.aeLoop, 0, nil)
+	assert.True(t, isShutdownInitiated())
+	c := newTestClient(t, "127.0.0.1:4000")
+	ReadQuery(c, "shutdown now force save\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.True(t, server.aeLoop.stop)
+	assert.Equal(t, 0, len(server.ipfd))
+}
+
+func TestShutdownPausesWrites(t *testing.T) {
+	conf := Config{ShutdownTimeout: 10}
+	assert.Nil(t, initServer(&conf))
+	a, _ := newTestClientPair(t, "127.0.0.1:1000")
+	b, peer := newTestClientPair(t, "127.0.0.1:2000")
+	ReadQuery(a, "shutdown\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+
+	// 等待期间写命令被推迟，读命令照常执行，CLIENT UNPAUSE 不能解除关闭时的暂停
+	ReadQuery(b, "get k\r\nclient unpause\r\nset k v\r\nget k\r\n")
+	assert.Nil(t, ProcessQueryBuf(b))
+	assert.NotZero(t, b.flags&CLIENT_BLOCKED)
+	assert.Equal(t, []*GoRedisClient{b}, server.pausedClients)
+	beforeSleep(server.aeLoop)
+	assert.Equal(t, []*GoRedisClient{b}, server.pausedClients)
+	buf := make([]byte, 64)
+	n, err := unix.Read(peer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "$-1\r\n+OK\r\n", string(buf[:n]))
+	assert.Nil(t, server.db.data.Get(CreateObject(GSTR, "k")))
+	// 暂停的写命令不会再产生回复，回复发送完之后退出
+	assert.True(t, server.aeLoop.stop)
+
+	// ABORT之后解除暂停，被推迟的写命令继续执行
+	assert.Nil(t, initServer(&conf))
+	a, _ = newTestClientPair(t, "127.0.0.1:1000")
+	b, peer = newTestClientPair(t, "127.0.0.1:2000")
+	ReadQuery(a, "shutdown\r\n")
+	assert.Nil(t, ProcessQueryBuf(a))
+	ReadQuery(b, "set k v\r\nget k\r\n")
+	assert.Nil(t, ProcessQueryBuf(b))
+	assert.NotZero(t, b.flags&CLIENT_BLOCKED)
+	c := newTestClient(t, "127.0.0.1:3000")
+	ReadQuery(c, "shutdown abort\r\n")
+	assert.Nil(t, ProcessQueryBuf(c))
+	assert.Equal(t, CLIENT_PAUSE_OFF, server.clientPauseType)
+	beforeSleep(server.aeLoop)
+	n, err = unix.Read(peer, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n$1\r\nv\r\n", string(buf[:n]))
+	assert.False(t, server.aeLoop.stop)
+	closeListeningSockets()
+}
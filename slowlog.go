@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SLOWLOG_ENTRY_MAX_ARGC   int = 32  // 每条记录最多保存的参数个数
+	SLOWLOG_ENTRY_MAX_STRING int = 128 // 每个参数最多保存的长度
+)
+
+type slowlogEntry struct {
+	id         int64
+	time       int64 // unix时间戳，秒
+	duration   int64 // us
+	args       []string
+	clientAddr string
+	clientName string
+}
+
+// slowlog 使用定长的环形数组，满了之后新的记录覆盖最旧的记录
+type slowlog struct {
+	entries []*slowlogEntry
+	head    int // 下一条记录写入的位置
+	length  int
+	nextId  int64
+}
+
+var slowLog slowlog
+
+func slowlogInit(maxLen int) {
+	slowLog = slowlog{
+		entries: make([]*slowlogEntry, maxLen),
+	}
+}
+
+// createSlowlogEntry 拷贝命令参数，参数过多或者过长时进行截断
+func createSlowlogEntry(c *GoRedisClient, duration int64) *slowlogEntry {
+	argc := len(c.args)
+	if argc > SLOWLOG_ENTRY_MAX_ARGC {
+		argc = SLOWLOG_ENTRY_MAX_ARGC
+	}
+	args := make([]string, argc)
+	for i := 0; i < argc; i++ {
+		// 最后一个位置用于说明还有多少参数没有记录
+		if argc != len(c.args) && i == argc-1 {
+			args[i] = fmt.Sprintf("... (%d more arguments)", len(c.args)-argc+1)
+			break
+		}
+		str := c.args[i].StrVal()
+		if len(str) > SLOWLOG_ENTRY_MAX_STRING {
+			str = fmt.Sprintf("%s... (%d more bytes)", str[:SLOWLOG_ENTRY_MAX_STRING], len(str)-SLOWLOG_ENTRY_MAX_STRING)
+		}
+		args[i] = str
+	}
+	e := &slowlogEntry{
+		id:         slowLog.nextId,
+		time:       time.Now().Unix(),
+		duration:   duration,
+		args:       args,
+		clientAddr: c.addr,
+		clientName: c.name,
+	}
+	slowLog.nextId++
+	return e
+}
+
+// slowlogPushEntryIfNeeded 命令执行时间超过slowlog-log-slower-than时记录下来
+func slowlogPushEntryIfNeeded(c *GoRedisClient, cmd *GoRedisCommand, duration int64) {
+	if server.config == nil || server.config.SlowlogLogSlowerThan < 0 || cmd.flags&CMD_SKIP_SLOWLOG != 0 {
+		return
+	}
+	if duration < int64(server.config.SlowlogLogSlowerThan) || len(slowLog.entries) == 0 {
+		return
+	}
+	slowLog.entries[slowLog.head] = createSlowlogEntry(c, duration)
+	slowLog.head = (slowLog.head + 1) % len(slowLog.entries)
+	if slowLog.length < len(slowLog.entries) {
+		slowLog.length++
+	}
+}
+
+func slowlogReset() {
+	for i := range slowLog.entries {
+		slowLog.entries[i] = nil
+	}
+	slowLog.head = 0
+	slowLog.length = 0
+}
+
+// slowlogGet 从新到旧返回最多count条记录，count为负数时返回全部
+func slowlogGet(count int) []*slowlogEntry {
+	if count < 0 || count > slowLog.length {
+		count = slowLog.length
+	}
+	res := make([]*slowlogEntry, 0, count)
+	size := len(slowLog.entries)
+	for i := 1; i <= count; i++ {
+		res = append(res, slowLog.entries[(slowLog.head-i+size)%size])
+	}
+	return res
+}
+
+func slowlogCommand(c *GoRedisClient) {
+	sub := strings.ToLower(c.args[1].StrVal())
+	switch {
+	case sub == "reset" && len(c.args) == 2:
+		slowlogReset()
+		c.AddReply(shared.ok)
+	case sub == "len" && len(c.args) == 2:
+		c.AddReplyInt(int64(slowLog.length))
+	case sub == "get" && (len(c.args) == 2 || len(c.args) == 3):
+		count := 10
+		if len(c.args) == 3 {
+			n, err := strconv.Atoi(c.args[2].StrVal())
+			if err != nil || n < -1 {
+				c.AddReplyError("count should be greater than or equal to -1")
+				return
+			}
+			count = n
+		}
+		entries := slowlogGet(count)
+		c.AddReplyArrayLen(len(entries))
+		for _, e := range entries {
+			c.AddReplyArrayLen(6)
+			c.AddReplyInt(e.id)
+			c.AddReplyInt(e.time)
+			c.AddReplyInt(e.duration)
+			c.AddReplyArrayLen(len(e.args))
+			for _, arg := range e.args {
+				c.AddReplyBulk(arg)
+			}
+			c.AddReplyBulk(e.clientAddr)
+			c.AddReplyBulk(e.clientName)
+		}
+	case sub == "help" && len(c.args) == 2:
+		help := []string{
+			"SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GET [<count>]",
+			"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+			"LEN",
+			"    Return the length of the slowlog.",
+			"RESET",
+			"    Reset the slowlog.",
+		}
+		c.AddReplyHelp(help)
+	default:
+		c.AddReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'", c.args[1].StrVal())
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TLS_READ_CHUNK 每次从socket读取密文的长度，正好是一个最大的TLS记录
+const TLS_READ_CHUNK int = 16 * 1024
+
+// errTlsWouldBlock 密文已经用完，需要等socket可读之后再继续
+var errTlsWouldBlock = &tlsWouldBlockError{}
+
+type tlsWouldBlockError struct{}
+
+func (e *tlsWouldBlockError) Error() string { return "tls: would block" }
+
+// Temporary crypto/tls 遇到临时错误时不会把连接标记为失败，下次还可以继续读
+func (e *tlsWouldBlockError) Timeout() bool   { return true }
+func (e *tlsWouldBlockError) Temporary() bool { return true }
+
+// tlsConn 把TLS和非阻塞的fd接起来。crypto/tls只和内存中的in/out打交道，
+// 真正的socket读写都在事件循环中完成，所以不会阻塞其他客户端。
+// 握手的错误在crypto/tls中不能重试，所以握手在一个单独的goroutine中进行，
+// 但是它和事件循环轮流执行(handshakeStep)，同一时刻只有一方在运行
+type tlsConn struct {
+	fd   int
+	conn *tls.Conn
+	rbuf []byte // 读socket用的缓冲区
+	in   []byte // 从socket读到，还没有交给crypto/tls的密文
+	out  []byte // crypto/tls产生，还没有写到socket的密文
+	eof  bool   // 对端已经关闭连接
+
+	handshaking bool
+	resume      chan struct{} // 事件循环 -> 握手goroutine，有新的密文或者连接被关闭
+	yield       chan error    // 握手goroutine -> 事件循环，errTlsWouldBlock表示需要更多密文
+	closed      bool
+}
+
+func newTlsConn(fd int, config *tls.Config) *tlsConn {
+	tc := &tlsConn{fd: fd}
+	tc.conn = tls.Server(&tlsMemConn{tc}, config)
+	return tc
+}
+
+// fill 从socket读一次密文，返回EAGAIN表示暂时没有数据，io.EOF表示对端关闭
+func (tc *tlsConn) fill() error {
+	if tc.rbuf == nil {
+		tc.rbuf = make([]byte, TLS_READ_CHUNK)
+	}
+	n, err := Read(tc.fd, tc.rbuf)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		tc.eof = true
+		return io.EOF
+	}
+	tc.in = append(tc.in, tc.rbuf[:n]...)
+	return nil
+}
+
+// flush 把out中的密文尽量写到socket，写不完的留到下次可写
+func (tc *tlsConn) flush() error {
+	for len(tc.out) > 0 {
+		n, err := Write(tc.fd, tc.out)
+		if err != nil {
+			return err
+		}
+		tc.out = tc.out[n:]
+	}
+	tc.out = nil
+	return nil
+}
+
+// startHandshake 启动握手的goroutine，并执行到第一次需要读取客户端数据为止
+func (tc *tlsConn) startHandshake() (bool, error) {
+	tc.handshaking = true
+	tc.resume = make(chan struct{})
+	// 带缓冲，连接被关闭后goroutine不会卡在发送上
+	tc.yield = make(chan error, 1)
+	go func() {
+		<-tc.resume
+		tc.yield <- tc.conn.Handshake()
+	}()
+	return tc.handshakeStep()
+}
+
+// handshakeStep 让握手goroutine处理in中的密文，直到它需要更多数据或者握手结束
+func (tc *tlsConn) handshakeStep() (bool, error) {
+	tc.resume <- struct{}{}
+	err := <-tc.yield
+	if err == errTlsWouldBlock {
+		return false, nil
+	}
+	tc.handshaking = false
+	return true, err
+}
+
+// Read 读出解密之后的数据，尽量填满buf，返回EAGAIN表示socket中暂时没有数据
+func (tc *tlsConn) Read(buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := tc.conn.Read(buf[n:])
+		n += m
+		if err == nil {
+			continue
+		}
+		if err != errTlsWouldBlock {
+			if n > 0 {
+				return n, nil
+			}
+			// 对端关闭连接时和普通连接一样返回0
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return 0, nil
+			}
+			return 0, err
+		}
+		if n > 0 {
+			break
+		}
+		if err = tc.fill(); err == io.EOF {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Writev 加密所有的数据，然后尽量写到socket，返回的是已经加密的明文长度，
+// 上一次的密文还没有写完时返回EAGAIN，等可写之后再继续
+func (tc *tlsConn) Writev(bufs [][]byte) (int, error) {
+	if err := tc.flush(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, b := range bufs {
+		m, err := tc.conn.Write(b)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if err := tc.flush(); err != nil && err != unix.EAGAIN {
+		return n, err
+	}
+	return n, nil
+}
+
+// pending 还有没写出去的密文
+func (tc *tlsConn) pending() bool {
+	return len(tc.out) > 0
+}
+
+// close 释放连接，正在握手的goroutine会因为读到EOF而退出
+func (tc *tlsConn) close() {
+	tc.closed = true
+	if tc.handshaking {
+		close(tc.resume)
+	}
+}
+
+// versionName 和openssl的命名一致，例如 TLSv1.3
+func (tc *tlsConn) versionName() string {
+	switch tc.conn.ConnectionState().Version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return ""
+}
+
+func (tc *tlsConn) cipherName() string {
+	state := tc.conn.ConnectionState()
+	if !state.HandshakeComplete {
+		return ""
+	}
+	return tls.CipherSuiteName(state.CipherSuite)
+}
+
+// tlsMemConn 是交给crypto/tls的net.Conn，只读写tlsConn中的in/out
+type tlsMemConn struct {
+	tc *tlsConn
+}
+
+func (c *tlsMemConn) Read(b []byte) (int, error) {
+	tc := c.tc
+	for len(tc.in) == 0 {
+		if tc.closed || tc.eof {
+			return 0, io.EOF
+		}
+		if !tc.handshaking {
+			return 0, errTlsWouldBlock
+		}
+		// 握手中没有数据时把控制权交还给事件循环
+		tc.yield <- errTlsWouldBlock
+		<-tc.resume
+	}
+	n := copy(b, tc.in)
+	tc.in = tc.in[n:]
+	return n, nil
+}
+
+func (c *tlsMemConn) Write(b []byte) (int, error) {
+	c.tc.out = append(c.tc.out, b...)
+	return len(b), nil
+}
+
+func (c *tlsMemConn) Close() error                       { return nil }
+func (c *tlsMemConn) LocalAddr() net.Addr                { return nil }
+func (c *tlsMemConn) RemoteAddr() net.Addr               { return nil }
+func (c *tlsMemConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *tlsMemConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *tlsMemConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// tlsConfigure 根据配置加载证书，没有配置tls-port时返回nil
+func tlsConfigure(config *Config) (*tls.Config, error) {
+	if config.TlsPort == 0 {
+		return nil, nil
+	}
+	if config.TlsCertFile == "" || config.TlsKeyFile == "" {
+		return nil, errors.New("tls-port requires tls-cert-file and tls-key-file")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TlsCertFile, config.TlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch config.TlsAuthClients {
+	case TLS_CLIENT_AUTH_NO:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case TLS_CLIENT_AUTH_OPTIONAL:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if config.TlsCaCertFile != "" {
+		pem, err := os.ReadFile(config.TlsCaCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", config.TlsCaCertFile)
+		}
+		tlsConfig.ClientCAs = pool
+	} else if tlsConfig.ClientAuth != tls.NoClientCert {
+		return nil, errors.New("tls-auth-clients requires tls-ca-cert-file")
+	}
+	return tlsConfig, nil
+}
+
+// tlsHandshake 客户端可读时推进握手，握手完成后继续按普通请求处理
+func tlsHandshake(client *GoRedisClient) {
+	tc := client.tls
+	err := tc.fill()
+	if err == unix.EAGAIN {
+		return
+	}
+	if err != nil && err != io.EOF {
+		log.Printf("tls handshake read err: %v\n", err)
+		freeClient(client)
+		return
+	}
+	done, err := tc.handshakeStep()
+	// 握手失败时也尽量把alert发给客户端
+	if ferr := tc.flush(); ferr != nil && ferr != unix.EAGAIN && err == nil {
+		err = ferr
+	}
+	if err != nil {
+		log.Printf("tls handshake with client %v failed: %v\n", client.addr, err)
+		freeClient(client)
+		return
+	}
+	if tc.pending() {
+		prepareTlsFlush(client)
+	}
+	if done {
+		log.Printf("tls handshake with client %v done, %v %v\n", client.addr, tc.versionName(), tc.cipherName())
+	}
+}
+
+// prepareTlsFlush 没写完的握手数据交给可写事件
+func prepareTlsFlush(client *GoRedisClient) {
+	if server.aeLoop.FileEvents[getFeKey(client.fd, AE_WRITABLE)] == nil {
+		server.aeLoop.AddFileEvent(client.fd, AE_WRITABLE, SendReplyToClient, client)
+	}
+}
+
+// processTlsPendingData crypto/tls中可能还有已经解密但是没有读出来的数据，
+// socket上没有新数据时epoll不会再通知，需要在beforeSleep中主动读
+func processTlsPendingData() {
+	for len(server.tlsPendingClients) > 0 {
+		pending := server.tlsPendingClients
+		server.tlsPendingClients = nil
+		for _, c := range pending {
+			c.flags &= ^CLIENT_TLS_PENDING
+			if c.flags&(CLIENT_CLOSED|CLIENT_CLOSE_ASAP) != 0 {
+				continue
+			}
+			ReadQueryFromClient(server.aeLoop, c.fd, c)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// genTestCert 生成一个证书，parent为nil时是自签名的CA
+func genTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// runLoopUntil 在当前goroutine中驱动事件循环，直到done返回
+func runLoopUntil(done chan error) error {
+	// 没有事件时也每10ms检查一次done
+	id := server.aeLoop.AddTimeEvent(AE_NORMAL, 10, func(*AeLoop, int, interface{}) {}, nil)
+	defer server.aeLoop.RemoveTimeEvent(id)
+	for {
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		beforeSleep(server.aeLoop)
+		server.aeLoop.AeProcess(server.aeLoop.AeWait())
+	}
+}
+
+func TestTls(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPem, _ := genTestCert(t, "ca", nil, nil)
+	_, _, certPem, keyPem := genTestCert(t, "server", ca, caKey)
+	_, _, clientCertPem, clientKeyPem := genTestCert(t, "client", ca, caKey)
+	conf := Config{
+		TlsPort:       1,
+		TlsCertFile:   filepath.Join(dir, "server.crt"),
+		TlsKeyFile:    filepath.Join(dir, "server.key"),
+		TlsCaCertFile: filepath.Join(dir, "ca.crt"),
+	}
+	assert.Nil(t, os.WriteFile(conf.TlsCertFile, certPem, 0600))
+	assert.Nil(t, os.WriteFile(conf.TlsKeyFile, keyPem, 0600))
+	assert.Nil(t, os.WriteFile(conf.TlsCaCertFile, caPem, 0600))
+	tlsConfig, err := tlsConfigure(&conf)
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	// 普通端口上按照tls-port的方式接受连接
+	var empty Config
+	assert.Nil(t, initServer(&empty))
+	defer closeListeningSockets()
+	sa, err := unix.Getsockname(server.ipfd[0])
+	assert.Nil(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*unix.SockaddrInet4).Port)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPem)
+	clientCert, err := tls.X509KeyPair(clientCertPem, clientKeyPem)
+	assert.Nil(t, err)
+
+	// 大的value会被拆成多个TLS记录，覆盖读不完和写不完的情况
+	value := strings.Repeat("v", 300*1024)
+	done := make(chan error, 1)
+	var reply string
+	var conn *tls.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	go func() {
+		var err error
+		conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+		if err != nil {
+			done <- err
+			return
+		}
+		req := fmt.Sprintf("*3\r\n$3\r\nset\r\n$1\r\nk\r\n$%d\r\n%s\r\nget k\r\nclient info\r\n", len(value), value)
+		if _, err = conn.Write([]byte(req)); err != nil {
+			done <- err
+			return
+		}
+		r := bufio.NewReader(conn)
+		var b strings.Builder
+		for _, n := range []int{len("+OK\r\n"), len(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))} {
+			buf := make([]byte, n)
+			if _, err = io.ReadFull(r, buf); err != nil {
+				done <- err
+				return
+			}
+			b.Write(buf)
+		}
+		line, err := r.ReadString('\n')
+		b.WriteString(line)
+		if err == nil {
+			line, err = r.ReadString('\n')
+			b.WriteString(line)
+		}
+		if err == nil {
+			line, err = r.ReadString('\n')
+			b.WriteString(line)
+		}
+		reply = b.String()
+		done <- err
+	}()
+	AcceptHandler(server.aeLoop, server.ipfd[0], tlsConfig)
+	assert.Nil(t, runLoopUntil(done))
+	assert.True(t, strings.HasPrefix(reply, "+OK\r\n$307200\r\n"+value+"\r\n$"))
+	assert.Contains(t, reply, " tls-version=TLSv1.3 tls-cipher=TLS_")
+	assert.Equal(t, 1, len(server.clientList))
+
+	// 没有客户端证书时握手失败，连接被关闭
+	go func() {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool})
+		if err == nil {
+			// TLS 1.3 中客户端在第一次读的时候才知道服务端拒绝了证书
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		done <- err
+	}()
+	AcceptHandler(server.aeLoop, server.ipfd[0], tlsConfig)
+	assert.NotNil(t, runLoopUntil(done))
+	for i := 0; i < 10 && len(server.clientList) > 1; i++ {
+		server.aeLoop.AeProcess(server.aeLoop.AeWait())
+	}
+	assert.Equal(t, 1, len(server.clientList))
+	freeClient(server.clientList[0])
+}
+
+func TestTlsConfig(t *testing.T) {
+	config := NewConfig()
+	assert.Nil(t, config.applyDirective("tls-port", []string{"6380"}))
+	assert.Nil(t, config.applyDirective("tls-auth-clients", []string{"optional"}))
+	assert.Equal(t, TLS_CLIENT_AUTH_OPTIONAL, config.TlsAuthClients)
+	assert.NotNil(t, config.applyDirective("tls-auth-clients", []string{"maybe"}))
+	_, err := tlsConfigure(config)
+	assert.NotNil(t, err)
+	config.TlsPort = 0
+	tlsConfig, err := tlsConfigure(config)
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes")
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+// splitArgs 按照redis的sdssplitargs规则切分参数，支持双引号转义、单引号以及连续空白
+// 例如 set k "hello\x20world" 'a b' 切分为 [set k hello world a b]
+func splitArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	p := 0
+	n := len(line)
+	for {
+		// 跳过空白
+		for p < n && isSpace(line[p]) {
+			p++
+		}
+		if p >= n {
+			return args, nil
+		}
+		var (
+			current []byte
+			inq     bool // 在双引号中
+			insq    bool // 在单引号中
+			done    bool
+		)
+		for !done {
+			if inq {
+				if p >= n {
+					return nil, ErrUnbalancedQuotes
+				}
+				if line[p] == '\\' && p+3 < n && line[p+1] == 'x' && isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					current = append(current, hexDigitToInt(line[p+2])*16+hexDigitToInt(line[p+3]))
+					p += 3
+				} else if line[p] == '\\' && p+1 < n {
+					p++
+					var c byte
+					switch line[p] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[p]
+					}
+					current = append(current, c)
+				} else if line[p] == '"' {
+					// 闭合的引号后面必须是空白或者结束
+					if p+1 < n && !isSpace(line[p+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else if insq {
+				if p >= n {
+					return nil, ErrUnbalancedQuotes
+				}
+				if line[p] == '\\' && p+1 < n && line[p+1] == '\'' {
+					p++
+					current = append(current, '\'')
+				} else if line[p] == '\'' {
+					if p+1 < n && !isSpace(line[p+1]) {
+						return nil, ErrUnbalancedQuotes
+					}
+					done = true
+				} else {
+					current = append(current, line[p])
+				}
+			} else {
+				if p >= n {
+					break
+				}
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', '\v', '\f':
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current = append(current, line[p])
+				}
+			}
+			if p < n {
+				p++
+			}
+		}
+		args = append(args, string(current))
+	}
+}
+
+// memToInt 把带单位的内存字符串转换成字节数，例如 1gb -> 1073741824
+// 和redis一样，k/m/g是1000的倍数，kb/mb/gb是1024的倍数
+func memToInt(s string) (int64, error) {
+	str := strings.ToLower(s)
+	var mul int64 = 1
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024},
+		{"mb", 1024 * 1024},
+		{"gb", 1024 * 1024 * 1024},
+		{"k", 1000},
+		{"m", 1000 * 1000},
+		{"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(str, u.suffix) {
+			str = str[:len(str)-len(u.suffix)]
+			mul = u.mul
+			break
+		}
+	}
+	val, err := strconv.ParseInt(str, 10, 64)
+	// 和redis的memtoull一样不接受负数，乘上单位之后溢出也是错误
+	if err != nil || val < 0 || val > math.MaxInt64/mul {
+		return 0, errors.New("invalid memory value: " + s)
+	}
+	return val * mul, nil
+}
+
+// quoteArg 按照redis的sdscatrepr给参数加上双引号，不可打印的字符转义为\xHH
+func quoteArg(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\a':
+			b.WriteString("\\a")
+		case '\b':
+			b.WriteString("\\b")
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&b, "\\x%02x", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func toLowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// stringMatch 按照redis的stringmatchlen实现glob风格的匹配，支持 * ? [a-z] [^a] 以及 \ 转义
+func stringMatch(pattern, str string, nocase bool) bool {
+	p, s := 0, 0
+	for p < len(pattern) && s <= len(str) {
+		switch pattern[p] {
+		case '*':
+			// 合并连续的*
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := s; i <= len(str); i++ {
+				if stringMatch(pattern[p+1:], str[i:], nocase) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == len(str) {
+				return false
+			}
+			s++
+		case '[':
+			if s == len(str) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for p < len(pattern) && pattern[p] != ']' {
+				if pattern[p] == '\\' && p+1 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					c := str[s]
+					if nocase {
+						start, end, c = toLowerByte(start), toLowerByte(end), toLowerByte(c)
+					}
+					if c >= start && c <= end {
+						match = true
+					}
+					p += 2
+				} else if nocase && toLowerByte(pattern[p]) == toLowerByte(str[s]) || pattern[p] == str[s] {
+					match = true
+				}
+				p++
+			}
+			if match == not {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if s == len(str) {
+				return false
+			}
+			if nocase {
+				if toLowerByte(pattern[p]) != toLowerByte(str[s]) {
+					return false
+				}
+			} else if pattern[p] != str[s] {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+// bytesToString 不拷贝地把[]byte转换成string，调用方需要保证之后不再修改b
+func bytesToString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// bytesToInt 类似redis的string2ll，直接解析[]byte中的十进制整数，不产生内存分配
+func bytesToInt(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	neg := false
+	if b[0] == '-' {
+		neg = true
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	n := 0
+	for _, ch := range b {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+		n = n*10 + int(ch-'0')
+	}
+	if neg {
+		n = -n
+	}
+	return n, true
+}